@@ -1,9 +1,13 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/speedland/lib/models/tv"
+	"github.com/speedland/lib/util"
 	"io"
+	"net/http"
+	"time"
 )
 
 func (c *ApiClient) GetTvRecords() ([]*tv.TvRecord, error) {
@@ -59,3 +63,83 @@ func (c *ApiClient) UploadPrograms(cid string, jsondata io.Reader) (map[string][
 func UploadPrograms(cid string, jsondata io.Reader) (map[string][]interface{}, error) {
 	return DefaultApiClient.UploadPrograms(cid, jsondata)
 }
+
+// UploadProgramsStream uploads the programs in the epgdump JSON by batches
+// of `size` programs without loading the whole document. The results of
+// the batches are merged, and broken programs are skipped and returned as
+// errors with the errors of the uploads.
+func (c *ApiClient) UploadProgramsStream(cid string, jsondata io.Reader, size int) (map[string][]interface{}, []error) {
+	merged := make(map[string][]interface{})
+	elist := tv.NewEpgParser(false).SplitEpgJson(jsondata, size, func(batch []byte) error {
+		result, err := c.UploadPrograms(cid, bytes.NewReader(batch))
+		if err != nil {
+			return err
+		}
+		for k, v := range result {
+			merged[k] = append(merged[k], v...)
+		}
+		return nil
+	})
+	return merged, elist
+}
+
+func UploadProgramsStream(cid string, jsondata io.Reader, size int) (map[string][]interface{}, []error) {
+	return DefaultApiClient.UploadProgramsStream(cid, jsondata, size)
+}
+
+// TvRecordResult is a recording outcome reported to the server.
+type TvRecordResult struct {
+	Id        string    `json:"id"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason"`
+	Degraded  string    `json:"degraded"` // reason of the degraded mode
+	Error     string    `json:"error"`
+	Restarts  int       `json:"restarts"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Files     []string  `json:"files"`
+	Size      int64     `json:"size"`
+}
+
+func NewTvRecordResult(result *tv.RecordResult) *TvRecordResult {
+	r := &TvRecordResult{
+		Id:        result.Record.Key(),
+		State:     result.State.String(),
+		Restarts:  result.Restarts,
+		StartedAt: result.StartedAt,
+		EndedAt:   result.EndedAt,
+	}
+	if result.State == tv.RSFailed {
+		r.Reason = result.Reason.String()
+	}
+	if result.Err != nil {
+		r.Error = result.Err.Error()
+	}
+	if result.Degraded != nil {
+		r.Degraded = tv.ClassifyFailure(result.Degraded).String()
+	}
+	if p, ok := result.Record.(tv.TvRecordProvider); ok {
+		rec := p.GetTvRecord()
+		r.Files = rec.Files
+		r.Size = rec.Size
+	}
+	return r
+}
+
+func (c *ApiClient) PostTvRecordResult(result *TvRecordResult) error {
+	endpoint := buildUrl(fmt.Sprintf("/api/pt/records/%s/result", result.Id))
+	if resp, err := c.Post(endpoint, "application/json", bytes.NewBufferString(util.FormatJson(result))); err != nil {
+		return err
+	} else {
+		if err = checkStatusCode(http.StatusOK, resp.StatusCode); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		var v map[string]interface{}
+		return handleAsJson(resp, &v)
+	}
+}
+
+func PostTvRecordResult(result *TvRecordResult) error {
+	return DefaultApiClient.PostTvRecordResult(result)
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/speedland/lib/models/tv"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// RecordFactory converts a TvRecord on the server into a Record which
+// actually records the program (e.g. by running recpt1).
+type RecordFactory func(*tv.TvRecord) (tv.Record, error)
+
+// RecordSyncer feeds a tv.Recorder with the records on the server and
+// reports the recording outcomes back to the server.
+//
+//	syncer := api.NewRecordSyncer(api.DefaultApiClient, factory)
+//	recorder := tv.NewRecorder(syncer.Receiver())
+//	syncer.Listen(recorder, pipeline)
+//	go recorder.Run()
+//	go syncer.Start()
+type RecordSyncer struct {
+	Interval time.Duration
+	// Path to save the last known schedule so that the recorder can work
+	// even if the server is unavailable when the process is restarted.
+	CacheFile string
+
+	client   *ApiClient
+	factory  RecordFactory
+	receiver chan []tv.Record
+	records  map[string]tv.Record
+	defs     map[string]*tv.TvRecord // definitions of records
+	last     []*tv.TvRecord
+	stopCh   chan bool
+	logger   wcg.Logger
+}
+
+func NewRecordSyncer(client *ApiClient, factory RecordFactory) *RecordSyncer {
+	return &RecordSyncer{
+		Interval: time.Duration(1 * time.Minute),
+		client:   client,
+		factory:  factory,
+		receiver: make(chan []tv.Record, 1),
+		records:  make(map[string]tv.Record),
+		defs:     make(map[string]*tv.TvRecord),
+		stopCh:   make(chan bool, 1),
+		logger:   util.GetLogger(),
+	}
+}
+
+// Receiver returns the channel to be passed to tv.NewRecorder.
+func (s *RecordSyncer) Receiver() <-chan []tv.Record {
+	return s.receiver
+}
+
+// Listen registers the syncer to report the outcomes of the recorder.
+// If p is not nil, succeeded records are processed by p before they are
+// reported so that the server gets the files after the processing, so p
+// should not Listen to the recorder by itself.
+func (s *RecordSyncer) Listen(r *tv.Recorder, p *tv.PostPipeline) {
+	r.OnResult(func(result *tv.RecordResult) {
+		go s.process(result, p)
+	})
+}
+
+func (s *RecordSyncer) process(result *tv.RecordResult, p *tv.PostPipeline) {
+	if provider, ok := result.Record.(tv.TvRecordProvider); ok && p != nil && result.State == tv.RSSucceeded {
+		p.Process(provider.GetTvRecord())
+	}
+	s.Report(result)
+}
+
+// Start polls the server by the interval until Stop is called.
+func (s *RecordSyncer) Start() {
+	s.Sync()
+	c := time.NewTicker(s.Interval)
+	defer c.Stop()
+	for {
+		select {
+		case <-c.C:
+			s.Sync()
+			break
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *RecordSyncer) Stop() {
+	select {
+	case s.stopCh <- true:
+	default:
+	}
+}
+
+// Sync gets the records from the server and pushes them to the receiver.
+// The last known schedule is pushed if the server is unavailable.
+func (s *RecordSyncer) Sync() error {
+	list, err := s.client.GetTvRecords()
+	if err != nil {
+		s.logger.Warn("Could not get records from the server, use the last known schedule: %v", err)
+		if s.last == nil {
+			s.last = s.loadCache()
+		}
+		list = s.last
+	} else {
+		if list == nil {
+			list = make([]*tv.TvRecord, 0)
+		}
+		s.last = list
+		s.saveCache(list)
+	}
+	if list != nil {
+		// an empty schedule from the server cancels all records.
+		s.push(s.convert(list))
+	}
+	return err
+}
+
+// Report posts the outcome of the record to the server.
+func (s *RecordSyncer) Report(result *tv.RecordResult) error {
+	err := s.client.PostTvRecordResult(NewTvRecordResult(result))
+	if err != nil {
+		s.logger.Error("%v: Could not report the result (%s): %v", result.Record, result.State, err)
+	}
+	return err
+}
+
+// convert returns the records for TvRecords. Records converted before are
+// reused unless their definitions are changed on the server.
+func (s *RecordSyncer) convert(list []*tv.TvRecord) []tv.Record {
+	records := make([]tv.Record, 0, len(list))
+	newmap := make(map[string]tv.Record)
+	newdefs := make(map[string]*tv.TvRecord)
+	for _, tvrec := range list {
+		if err := tv.RecordValidator.Eval(tvrec); err != nil {
+			s.logger.Warn("%v: Invalid record is skipped: %v", tvrec, err)
+			continue
+		}
+		rec, ok := s.records[tvrec.Id]
+		if !ok || !sameDefinition(s.defs[tvrec.Id], tvrec) {
+			var err error
+			if rec, err = s.factory(tvrec); err != nil {
+				s.logger.Error("%v: Could not create a record: %v", tvrec, err)
+				continue
+			}
+		}
+		newmap[tvrec.Id] = rec
+		newdefs[tvrec.Id] = tvrec
+		records = append(records, rec)
+	}
+	s.records = newmap
+	s.defs = newdefs
+	return records
+}
+
+// sameDefinition returns true if the TvRecords record the same program in
+// the same way.
+func sameDefinition(a *tv.TvRecord, b *tv.TvRecord) bool {
+	return a != nil && b != nil &&
+		a.UpdatedAt.Equal(b.UpdatedAt) &&
+		a.Title == b.Title && a.Category == b.Category &&
+		a.StartAt.Equal(b.StartAt) && a.EndAt.Equal(b.EndAt) &&
+		a.Cid == b.Cid && a.Sid == b.Sid && a.InputIdx == b.InputIdx &&
+		a.PrePadding == b.PrePadding && a.PostPadding == b.PostPadding
+}
+
+// push replaces the pending schedule in the receiver with the latest one.
+func (s *RecordSyncer) push(records []tv.Record) {
+	select {
+	case <-s.receiver:
+	default:
+	}
+	s.receiver <- records
+}
+
+func (s *RecordSyncer) loadCache() []*tv.TvRecord {
+	if s.CacheFile == "" {
+		return nil
+	}
+	buff, err := ioutil.ReadFile(s.CacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("Could not read the cache %q: %v", s.CacheFile, err)
+		}
+		return nil
+	}
+	var list []*tv.TvRecord
+	if err := json.Unmarshal(buff, &list); err != nil {
+		s.logger.Warn("Could not decode the cache %q: %v", s.CacheFile, err)
+		return nil
+	}
+	return list
+}
+
+func (s *RecordSyncer) saveCache(list []*tv.TvRecord) {
+	if s.CacheFile == "" {
+		return
+	}
+	if err := ioutil.WriteFile(s.CacheFile, []byte(util.FormatJson(list)), 0644); err != nil {
+		s.logger.Warn("Could not write the cache %q: %v", s.CacheFile, err)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/speedland/lib"
+	"github.com/speedland/lib/models/tv"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testRecord struct {
+	rec *tv.TvRecord
+}
+
+func (r *testRecord) Key() string                  { return r.rec.Key() }
+func (r *testRecord) Start() error                 { return nil }
+func (r *testRecord) Stop() error                  { return nil }
+func (r *testRecord) IsRunning() bool              { return false }
+func (r *testRecord) StartAt() time.Time           { return r.rec.StartAt }
+func (r *testRecord) EndAt() time.Time             { return r.rec.EndAt }
+func (r *testRecord) CheckInterval() time.Duration { return time.Second }
+func (r *testRecord) GetTvRecord() *tv.TvRecord    { return r.rec }
+
+func testRecordFactory(rec *tv.TvRecord) (tv.Record, error) {
+	return &testRecord{rec}, nil
+}
+
+func TestRecordSyncer(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	start := time.Now().Add(time.Hour)
+	records := []*tv.TvRecord{
+		tv.NewTvRecord("title", "category", start, start.Add(30*time.Minute), "20", "hd", "me"),
+		tv.NewTvRecord("", "invalid", start, start.Add(30*time.Minute), "20", "hd", "me"),
+	}
+	available := true
+	var reported *TvRecordResult
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/api/pt/records/":
+			json.NewEncoder(w).Encode(records)
+		case req.Method == "POST" && req.URL.Path == "/api/pt/records/"+records[0].Id+"/result":
+			json.NewDecoder(req.Body).Decode(&reported)
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	endpoint := lib.Config.Endpoint
+	defer func() { lib.Config.Endpoint = endpoint }()
+	lib.Config.Endpoint, _ = url.Parse(server.URL)
+
+	util.WithTempDir(func(dir string) {
+		syncer := NewRecordSyncer(DefaultApiClient, testRecordFactory)
+		syncer.CacheFile = filepath.Join(dir, "records.json")
+		assert.Nil(syncer.Sync(), "Sync should not return an error.")
+		list := <-syncer.Receiver()
+		assert.EqInt(1, len(list), "Invalid record should be skipped.")
+		assert.EqStr(records[0].Id, list[0].Key(), "Record should be converted.")
+
+		available = false
+		assert.NotNil(syncer.Sync(), "Sync should return an error when the server is unavailable.")
+		list2 := <-syncer.Receiver()
+		assert.EqInt(1, len(list2), "Last known schedule should be pushed.")
+		assert.Ok(list[0] == list2[0], "Record should be reused.")
+
+		available = true
+		records[0].Cid = "21"
+		assert.Nil(syncer.Sync(), "Sync should not return an error.")
+		list2 = <-syncer.Receiver()
+		assert.Ok(list[0] != list2[0], "Record should be rebuilt when the channel is changed.")
+		assert.EqStr("21", list2[0].(*testRecord).rec.Cid, "Record should have the new channel.")
+		available = false
+
+		// restarted process
+		syncer = NewRecordSyncer(DefaultApiClient, testRecordFactory)
+		syncer.CacheFile = filepath.Join(dir, "records.json")
+		syncer.Sync()
+		list = <-syncer.Receiver()
+		assert.EqInt(1, len(list), "Cached schedule should be pushed.")
+
+		available = true
+		err := syncer.Report(&tv.RecordResult{
+			Record: list[0],
+			State:  tv.RSFailed,
+			Reason: tv.FRTunerBusy,
+		})
+		assert.Nil(err, "Report should not return an error.")
+		assert.EqStr("failed", reported.State, "State should be reported.")
+		assert.EqStr("tuner busy", reported.Reason, "Reason should be reported.")
+
+		// the last reservation is deleted on the server.
+		records = nil
+		assert.Nil(syncer.Sync(), "Sync should not return an error.")
+		list = <-syncer.Receiver()
+		assert.EqInt(0, len(list), "Empty schedule should be pushed.")
+	})
+}
+
+type renameStep struct{}
+
+func (s *renameStep) Name() string {
+	return "rename"
+}
+
+func (s *renameStep) Run(rec *tv.TvRecord) error {
+	rec.Files = []string{"/library/a.ts"}
+	rec.Size = 10
+	return nil
+}
+
+func TestRecordSyncer_ReportAfterPostProcess(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	start := time.Now().Add(time.Hour)
+	rec := tv.NewTvRecord("title", "category", start, start.Add(30*time.Minute), "20", "hd", "me")
+	rec.Files = []string{"/rec/a.ts"}
+	var reported *TvRecordResult
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&reported)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	endpoint := lib.Config.Endpoint
+	defer func() { lib.Config.Endpoint = endpoint }()
+	lib.Config.Endpoint, _ = url.Parse(server.URL)
+
+	syncer := NewRecordSyncer(DefaultApiClient, testRecordFactory)
+	pipeline := tv.NewPostPipeline().Add(&renameStep{}, 0, 0)
+	syncer.process(&tv.RecordResult{Record: &testRecord{rec}, State: tv.RSSucceeded}, pipeline)
+	assert.NotNil(reported, "Result should be reported.")
+	assert.EqInt(1, len(reported.Files), "Files should be reported.")
+	assert.EqStr("/library/a.ts", reported.Files[0], "Files after the post processing should be reported.")
+	assert.EqInt(10, int(reported.Size), "Size after the post processing should be reported.")
+}
@@ -0,0 +1,227 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util/jptext"
+	"github.com/speedland/wcg"
+	v "github.com/speedland/wcg/validation"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AutoReserveRule is a rule to reserve programs in the EPG automatically.
+// All conditions which are set should be satisfied to match a program.
+type AutoReserveRule struct {
+	Id            string   `json:"id"`
+	Name          string   `json:"name"`
+	TitlePattern  string   `json:"title_pattern"`  // regexp for Title or the normalized Title
+	DetailPattern string   `json:"detail_pattern"` // regexp for Detail and ExtDetails
+	Categories    []string `json:"categories"`     // Category.Large or Category.Middle
+	Channels      []string `json:"channels"`       // Cid or TvChannel.Key() (Cid.Sid)
+	TimeFrom      int      `json:"time_from"`      // minutes from 00:00 JST, TimeFrom > TimeTo crosses the midnight.
+	TimeTo        int      `json:"time_to"`        // both 0 for all day.
+	Excludes      []string `json:"excludes"`       // words which should not be in Title or Detail.
+	// for the reserved records
+	Category  string    `json:"category"`
+	Uid       string    `json:"uid"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	titleRegexp  *regexp.Regexp
+	detailRegexp *regexp.Regexp
+}
+
+var AutoReserveRuleValidator = v.NewObjectValidator()
+
+func init() {
+	AutoReserveRuleValidator.Field("Id").Required().Match(ValidUUID)
+	AutoReserveRuleValidator.Field("Name").Required().Min(1).Max(64)
+	AutoReserveRuleValidator.Field("Category").Required().
+		Unmatch(InvalidChars).Min(1).Max(64)
+	AutoReserveRuleValidator.Func(func(r interface{}) *v.FieldValidationError {
+		rule := r.(*AutoReserveRule)
+		if rule.TitlePattern == "" && rule.DetailPattern == "" && len(rule.Categories) == 0 {
+			return v.NewFieldValidationError("条件が指定されていません。", nil)
+		}
+		if err := rule.Compile(); err != nil {
+			return v.NewFieldValidationError("正規表現が不正です。", nil)
+		}
+		return nil
+	})
+}
+
+func NewAutoReserveRule(name string, category string, uid string) *AutoReserveRule {
+	now := time.Now()
+	return &AutoReserveRule{
+		Id:         wcg.Must(wcg.UUID()).(string),
+		Name:       name,
+		Categories: make([]string, 0),
+		Channels:   make([]string, 0),
+		Excludes:   make([]string, 0),
+		Category:   category,
+		Uid:        uid,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+}
+
+// NewAutoReserveRuleFromCrawlerConfig returns the rule which matches the
+// programs by the keyword of the crawler config.
+func NewAutoReserveRuleFromCrawlerConfig(cfg *CrawlerConfig, uid string) *AutoReserveRule {
+	rule := NewAutoReserveRule(cfg.Keyword, cfg.Category, uid)
+	rule.TitlePattern = regexp.QuoteMeta(cfg.Keyword)
+	return rule
+}
+
+func (rule *AutoReserveRule) Key() string {
+	return rule.Id
+}
+
+func (rule *AutoReserveRule) String() string {
+	return "AutoReserveRule:" + rule.Key()
+}
+
+// Compile compiles the patterns and caches the regexps. Match compiles the
+// patterns which are changed after Compile without updating the cache, so
+// Compile should be called again before the rule is shared.
+func (rule *AutoReserveRule) Compile() error {
+	title, detail, err := rule.regexps()
+	if err != nil {
+		return err
+	}
+	rule.titleRegexp, rule.detailRegexp = title, detail
+	return nil
+}
+
+// regexps returns the cached regexps if they are compiled from the current
+// patterns, otherwise compiles them.
+func (rule *AutoReserveRule) regexps() (title *regexp.Regexp, detail *regexp.Regexp, err error) {
+	if title, err = compilePattern(rule.titleRegexp, rule.TitlePattern); err != nil {
+		return nil, nil, fmt.Errorf("Invalid title pattern %q: %v", rule.TitlePattern, err)
+	}
+	if detail, err = compilePattern(rule.detailRegexp, rule.DetailPattern); err != nil {
+		return nil, nil, fmt.Errorf("Invalid detail pattern %q: %v", rule.DetailPattern, err)
+	}
+	return title, detail, nil
+}
+
+func compilePattern(cached *regexp.Regexp, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if cached != nil && cached.String() == pattern {
+		return cached, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func (rule *AutoReserveRule) Match(epg *Epg) bool {
+	title, detail, err := rule.regexps()
+	if err != nil {
+		return false
+	}
+	if title != nil && !matchTitle(title, epg) {
+		return false
+	}
+	if detail != nil && !matchDetail(detail, epg) {
+		return false
+	}
+	if len(rule.Categories) > 0 && !rule.matchCategory(epg) {
+		return false
+	}
+	if len(rule.Channels) > 0 && !rule.matchChannel(epg) {
+		return false
+	}
+	if !rule.matchTime(epg.StartAt) {
+		return false
+	}
+	if len(rule.Excludes) > 0 {
+		title, detail := jptext.Fold(epg.Title), jptext.Fold(string(epg.Detail))
+		for _, word := range rule.Excludes {
+			if word = jptext.Fold(word); word != "" && (strings.Contains(title, word) || strings.Contains(detail, word)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchTitle(re *regexp.Regexp, epg *Epg) bool {
+	return re.MatchString(epg.Title) || re.MatchString(jptext.Normalize(epg.Title))
+}
+
+// matchDetail matches Detail and the values of ExtDetails. The keys are
+// not matched since they are common labels like "出演者".
+func matchDetail(re *regexp.Regexp, epg *Epg) bool {
+	if re.Match(epg.Detail) {
+		return true
+	}
+	for _, v := range epg.ExtDetails {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *AutoReserveRule) matchCategory(epg *Epg) bool {
+	for _, c := range epg.Categories {
+		for _, name := range rule.Categories {
+			if c.Large == name || c.Middle == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule *AutoReserveRule) matchChannel(epg *Epg) bool {
+	key := fmt.Sprintf("%s.%s", epg.Cid, epg.Sid)
+	for _, ch := range rule.Channels {
+		if ch == epg.Cid || ch == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *AutoReserveRule) matchTime(t time.Time) bool {
+	if rule.TimeFrom == 0 && rule.TimeTo == 0 {
+		return true
+	}
+	t = t.In(jst)
+	m := t.Hour()*60 + t.Minute()
+	if rule.TimeFrom <= rule.TimeTo {
+		return rule.TimeFrom <= m && m < rule.TimeTo
+	}
+	return rule.TimeFrom <= m || m < rule.TimeTo
+}
+
+// Reserve returns the records for the programs matched with the rule, which
+// are not duplicated with the existing records. Programs which cannot be
+// valid records are returned as errors.
+func (rule *AutoReserveRule) Reserve(epgs []*Epg, existing []*TvRecord) ([]*TvRecord, []error) {
+	if err := rule.Compile(); err != nil {
+		return nil, []error{err}
+	}
+	list := make([]*TvRecord, 0)
+	errors := make([]error, 0)
+	for _, epg := range epgs {
+		if !rule.Match(epg) {
+			continue
+		}
+		r := epg.ToTvRecord(rule.Category, rule.Uid)
+		r.RuleId = rule.Id
+		if err := RecordValidator.Eval(r); err != nil {
+			errors = append(errors, fmt.Errorf("%q (event: %d) could not be reserved: %v", epg.Title, epg.EventId, err))
+			continue
+		}
+		list = append(list, r)
+	}
+	list = DedupeRecords(existing, list)
+	if len(errors) > 0 {
+		return list, errors
+	}
+	return list, nil
+}
@@ -0,0 +1,104 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+	"time"
+)
+
+func genTestEpgs() []*Epg {
+	base := time.Date(2014, 12, 5, 0, 0, 0, 0, jst)
+	return []*Epg{
+		&Epg{
+			EventId:    1,
+			Title:      "The Girls Live",
+			Detail:     []byte("道重さゆみ卒業ライブに密着"),
+			StartAt:    base.Add(1 * time.Hour),
+			EndAt:      base.Add(90 * time.Minute),
+			Cid:        "GR7",
+			Sid:        "1072",
+			Categories: []Category{Category{Large: "音楽", Middle: "国内ロック・ポップス"}},
+			ExtDetails: map[string]string{"出演者": "モーニング娘。"},
+		},
+		&Epg{
+			EventId:    2,
+			Title:      "The Girls Live【再】",
+			Detail:     []byte("再放送"),
+			StartAt:    base.Add(13 * time.Hour),
+			EndAt:      base.Add(810 * time.Minute),
+			Cid:        "GR7",
+			Sid:        "1072",
+			Categories: []Category{Category{Large: "音楽", Middle: "国内ロック・ポップス"}},
+		},
+		&Epg{
+			EventId:    3,
+			Title:      "ニュース",
+			Detail:     []byte("モーニング娘。が出演"),
+			StartAt:    base.Add(18 * time.Hour),
+			EndAt:      base.Add(19 * time.Hour),
+			Cid:        "GR5",
+			Sid:        "1064",
+			Categories: []Category{Category{Large: "ニュース／報道", Middle: "定時・総合"}},
+		},
+	}
+}
+
+func TestAutoReserveRuleMatch(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	epgs := genTestEpgs()
+
+	rule := NewAutoReserveRule("girls", "music", "me")
+	rule.TitlePattern = "Girls"
+	assert.Nil(rule.Compile(), "Compile")
+	assert.Ok(rule.Match(epgs[0]), "Title")
+	rule.TitlePattern = "Boys"
+	assert.Ok(!rule.Match(epgs[0]), "Changed pattern should be used.")
+	rule.TitlePattern = "Girls"
+	assert.Ok(rule.Match(epgs[1]), "Title")
+	assert.Ok(!rule.Match(epgs[2]), "Title")
+
+	rule.Excludes = []string{"【再】"}
+	assert.Ok(rule.Match(epgs[0]), "Excludes")
+	assert.Ok(!rule.Match(epgs[1]), "Excludes")
+	rule.Excludes = []string{"[再]"}
+	assert.Ok(!rule.Match(epgs[1]), "Excludes should be normalized.")
+	rule.Excludes = nil
+	assert.Ok(rule.Match(&Epg{Title: "Ｔｈｅ Ｇｉｒｌｓ Ｌｉｖｅ"}), "Title should be normalized.")
+
+	rule = NewAutoReserveRule("morning", "music", "me")
+	rule.DetailPattern = "モーニング娘"
+	assert.Ok(rule.Match(epgs[0]), "ExtDetails")
+	assert.Ok(rule.Match(epgs[2]), "Detail")
+	rule.DetailPattern = "出演"
+	assert.Ok(!rule.Match(epgs[0]), "Keys of ExtDetails should not be matched.")
+	rule.DetailPattern = "モーニング娘"
+	rule.Categories = []string{"音楽"}
+	assert.Ok(rule.Match(epgs[0]), "Categories")
+	assert.Ok(!rule.Match(epgs[2]), "Categories")
+
+	rule = NewAutoReserveRule("night", "music", "me")
+	rule.Channels = []string{"GR7.1072"}
+	rule.TimeFrom = 23 * 60
+	rule.TimeTo = 2 * 60
+	assert.Ok(rule.Match(epgs[0]), "Time crossing midnight")
+	assert.Ok(!rule.Match(epgs[1]), "Time crossing midnight")
+	assert.Ok(!rule.Match(epgs[2]), "Channels")
+}
+
+func TestAutoReserveRuleReserve(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	epgs := genTestEpgs()
+	rule := NewAutoReserveRuleFromCrawlerConfig(&CrawlerConfig{Keyword: "Girls", Category: "music"}, "me")
+	assert.Nil(AutoReserveRuleValidator.Eval(rule), "Rule should be valid.")
+
+	existing := []*TvRecord{epgs[1].ToTvRecord("music", "me")}
+	records, errs := rule.Reserve(epgs, existing)
+	assert.Nil(errs, "Reserve should not return errors.")
+	assert.EqInt(1, len(records), "Reserved records should not be duplicated.")
+	assert.EqInt(1, records[0].EventId, "EventId")
+	assert.EqStr(rule.Id, records[0].RuleId, "RuleId")
+
+	rule.TitlePattern = "("
+	_, errs = rule.Reserve(epgs, nil)
+	assert.NotNil(errs, "Reserve should return an error for an invalid pattern.")
+}
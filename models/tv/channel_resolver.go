@@ -0,0 +1,145 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util/jptext"
+	"regexp"
+	"strings"
+)
+
+// Min similarity of the station names to be regarded as the same channel.
+var StationNameSimilarity = 0.6
+
+// ChannelResolver finds the TvChannel of an iEPG station by IEpgStationId,
+// or by the name of the station if the id is unknown.
+type ChannelResolver struct {
+	channels  []*TvChannel
+	byStation map[string]*TvChannel
+	byName    map[string]*TvChannel
+}
+
+func NewChannelResolver(channels []*TvChannel) *ChannelResolver {
+	r := &ChannelResolver{
+		channels:  channels,
+		byStation: make(map[string]*TvChannel),
+		byName:    make(map[string]*TvChannel),
+	}
+	for _, ch := range channels {
+		if ch.IEpgStationId != "" {
+			r.byStation[ch.IEpgStationId] = ch
+		}
+		r.byName[normalizeStationName(ch.Name)] = ch
+	}
+	return r
+}
+
+// Resolve returns the channel by the station id, the exact name, or the most
+// similar name. An error is returned if it is not found or ambiguous.
+func (r *ChannelResolver) Resolve(stationId string, stationName string) (*TvChannel, error) {
+	if ch, ok := r.byStation[stationId]; ok && stationId != "" {
+		return ch, nil
+	}
+	name := normalizeStationName(stationName)
+	if name == "" {
+		return nil, fmt.Errorf("No channel is configured for the station %q.", stationId)
+	}
+	if ch, ok := r.byName[name]; ok {
+		return ch, nil
+	}
+	var found []*TvChannel
+	best := 0.0
+	for _, ch := range r.channels {
+		score := stationNameSimilarity(name, normalizeStationName(ch.Name))
+		switch {
+		case score < StationNameSimilarity || score < best:
+			continue
+		case score > best:
+			best, found = score, []*TvChannel{ch}
+		default:
+			found = append(found, ch)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No channel is configured for the station %q (%s).", stationId, stationName)
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, ch := range found {
+		names[i] = ch.String()
+	}
+	return nil, fmt.Errorf("Station %q (%s) is ambiguous: %s", stationId, stationName, strings.Join(names, ", "))
+}
+
+// ResolveIEpg fills iepg.Cid and iepg.Sid.
+func (r *ChannelResolver) ResolveIEpg(iepg *IEpg) error {
+	ch, err := r.Resolve(iepg.StationId, iepg.StationName)
+	if err != nil {
+		return err
+	}
+	iepg.Cid, iepg.Sid = ch.Cid, ch.Sid
+	return nil
+}
+
+// ToTvRecord returns the record of the iEPG for the user, which is
+// validated by RecordValidator.
+func (r *ChannelResolver) ToTvRecord(iepg *IEpg, uid string) (*TvRecord, error) {
+	if err := r.ResolveIEpg(iepg); err != nil {
+		return nil, fmt.Errorf("%q (iEPG %s) could not be reserved: %v", iepg.ProgramTitle, iepg.Id, err)
+	}
+	rec := iepg.ToTvRecord()
+	rec.Uid = uid
+	if err := RecordValidator.Eval(rec); err != nil {
+		return nil, fmt.Errorf("%q (iEPG %s) could not be reserved: %v", iepg.ProgramTitle, iepg.Id, err)
+	}
+	return rec, nil
+}
+
+// Channel numbers like "(Ch.7)" and spaces are removed.
+var stationNameNoise = regexp.MustCompile(`\(ch\.?\s*[0-9]+\)|\s+`)
+
+func normalizeStationName(name string) string {
+	return stationNameNoise.ReplaceAllString(jptext.Fold(name), "")
+}
+
+// stationNameSimilarity returns 1 if a name contains the other, or the Dice
+// coefficient of the bigrams.
+func stationNameSimilarity(a string, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	if strings.Contains(a, b) || strings.Contains(b, a) {
+		return 1
+	}
+	ba, bb := bigrams(a), bigrams(b)
+	if len(ba) == 0 || len(bb) == 0 {
+		return 0
+	}
+	common := 0
+	for g, n := range ba {
+		if m, ok := bb[g]; ok {
+			if m < n {
+				n = m
+			}
+			common += n
+		}
+	}
+	total := 0
+	for _, n := range ba {
+		total += n
+	}
+	for _, n := range bb {
+		total += n
+	}
+	return 2 * float64(common) / float64(total)
+}
+
+func bigrams(s string) map[string]int {
+	runes := []rune(s)
+	grams := make(map[string]int)
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])] += 1
+	}
+	return grams
+}
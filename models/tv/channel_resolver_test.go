@@ -0,0 +1,74 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+	"time"
+)
+
+func genTestChannels() []*TvChannel {
+	return []*TvChannel{
+		&TvChannel{Cid: "GR4", Sid: "1040", Name: "日本テレビ", IEpgStationId: "DFS00400"},
+		&TvChannel{Cid: "GR7", Sid: "1072", Name: "テレビ東京"},
+		&TvChannel{Cid: "BS15", Sid: "101", Name: "NHK BS1"},
+		&TvChannel{Cid: "BS15", Sid: "102", Name: "NHK BS2"},
+	}
+}
+
+func TestChannelResolver(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	r := NewChannelResolver(genTestChannels())
+
+	ch, err := r.Resolve("DFS00400", "")
+	assert.Nil(err, "Resolve by IEpgStationId")
+	assert.EqStr("GR4", ch.Cid, "Cid")
+
+	ch, err = r.Resolve("DFS00430", "テレビ東京")
+	assert.Nil(err, "Resolve by the name")
+	assert.EqStr("GR7", ch.Cid, "Cid")
+
+	ch, err = r.Resolve("", "テレビ東京(Ch.7)")
+	assert.Nil(err, "Resolve by the name with the channel number")
+	assert.EqStr("1072", ch.Sid, "Sid")
+
+	ch, err = r.Resolve("", "ＮＨＫ　ＢＳ１")
+	assert.Nil(err, "Resolve by the normalized name")
+	assert.EqStr("101", ch.Sid, "Sid")
+
+	ch, err = r.Resolve("", "日本テレビ放送網")
+	assert.Nil(err, "Resolve by the similar name")
+	assert.EqStr("GR4", ch.Cid, "Cid")
+
+	_, err = r.Resolve("", "NHK")
+	assert.NotNil(err, "Resolve should fail for an ambiguous name.")
+	_, err = r.Resolve("DFS99999", "TBS")
+	assert.NotNil(err, "Resolve should fail for an unknown station.")
+}
+
+func TestChannelResolver_ToTvRecord(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	r := NewChannelResolver(genTestChannels())
+	start := time.Date(2014, 12, 5, 1, 0, 0, 0, jst)
+	iepg := &IEpg{
+		Id:           "101072201412050100",
+		StationId:    "DFS00430",
+		StationName:  "テレビ東京",
+		ProgramTitle: "The　Girls　Live",
+		Category:     "music",
+		StartAt:      start,
+		EndAt:        start.Add(30 * time.Minute),
+	}
+	rec, err := r.ToTvRecord(iepg, "me")
+	assert.Nil(err, "ToTvRecord should return a valid record.")
+	assert.EqStr("GR7", rec.Cid, "Cid")
+	assert.EqStr("1072", rec.Sid, "Sid")
+	assert.EqStr("me", rec.Uid, "Uid")
+
+	iepg.Category = ""
+	_, err = r.ToTvRecord(iepg, "me")
+	assert.NotNil(err, "ToTvRecord should validate the record.")
+
+	iepg.StationName = "TBS"
+	_, err = r.ToTvRecord(iepg, "me")
+	assert.NotNil(err, "ToTvRecord should fail for an unknown station.")
+}
@@ -0,0 +1,134 @@
+package tv
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is an abstraction of the current time and timers so that
+// components driven by deadlines can be tested without sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is a Clock backed by the time package.
+var SystemClock Clock = &systemClock{}
+
+type systemClock struct{}
+
+func (c *systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// FakeClock is a Clock which only moves when Advance is called.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{
+		now: now,
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// BlockUntil waits until at least n timers are waiting for the clock, which
+// tells that the components have reacted to the last Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		ch:    make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.ch <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+		c.cond.Broadcast()
+	}
+	return t
+}
+
+// Advance moves the clock forward and fires all timers which get expired.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	timers := make([]*fakeTimer, 0)
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+		} else {
+			t.ch <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+func (c *FakeClock) removeTimer(t *fakeTimer) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, v := range c.timers {
+		if v == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.removeTimer(t)
+}
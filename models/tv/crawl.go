@@ -0,0 +1,169 @@
+package tv
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Default settings of Crawler.
+var (
+	DefaultCrawlConcurrency = 4
+	DefaultCrawlInterval    = 1 * time.Second // per host
+)
+
+// ErrCrawlFailed is an error to fetch an iEPG in CrawlConfig.
+type ErrCrawlFailed struct {
+	Id  string
+	Err error
+}
+
+func (e *ErrCrawlFailed) Error() string {
+	return fmt.Sprintf("iEPG %s: %v", e.Id, e.Err)
+}
+
+// CrawlConfig searches the programs by the config in cfg.Source (or c.Source
+// if it is empty) and fetches their iEPGs with up to c.Concurrency requests
+// at a time. The IEpgs have Cid and Sid resolved by a ChannelResolver of
+// c.Channels and the Category of the config.
+// The programs rejected by c.Filter are not fetched.
+// The errors of each iEPG are returned as *ErrCrawlFailed.
+func (c *Crawler) CrawlConfig(cfg *CrawlerConfig) ([]*IEpg, []error) {
+	source := c.Source
+	if cfg.Source != "" {
+		var ok bool
+		if source, ok = GetEpgSource(cfg.Source); !ok {
+			return nil, []error{fmt.Errorf("Unknown EPG source %q", cfg.Source)}
+		}
+	}
+	if source == nil {
+		return nil, []error{fmt.Errorf("No EPG source is configured")}
+	}
+	getter := HttpGetterFunc(c.get)
+	ids, err := c.search(source, getter, cfg)
+	if err != nil {
+		return nil, []error{err}
+	}
+	ids = dedupeStrings(ids)
+	var resolver *ChannelResolver
+	if c.Channels != nil {
+		resolver = NewChannelResolver(c.Channels)
+	}
+	results := make([]*IEpg, len(ids))
+	errors := make([]error, len(ids))
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- true
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			iepg, err := source.Fetch(getter, id)
+			if err == nil {
+				iepg.Id = id
+			}
+			if err == nil && resolver != nil {
+				err = resolver.ResolveIEpg(iepg)
+			}
+			if err != nil {
+				errors[i] = &ErrCrawlFailed{Id: id, Err: err}
+				return
+			}
+			iepg.Category = cfg.Category
+			results[i] = iepg
+		}(i, id)
+	}
+	wg.Wait()
+
+	list := make([]*IEpg, 0, len(ids))
+	elist := make([]error, 0)
+	for i := range ids {
+		if results[i] != nil {
+			list = append(list, results[i])
+		}
+		if errors[i] != nil {
+			elist = append(elist, errors[i])
+		}
+	}
+	if len(elist) > 0 {
+		return list, elist
+	}
+	return list, nil
+}
+
+// search returns the ids of the programs, which are filtered by c.Filter
+// if the source provides the feed items.
+func (c *Crawler) search(source EpgSource, g HttpGetter, cfg *CrawlerConfig) ([]string, error) {
+	fs, ok := source.(FeedEpgSource)
+	if !ok || c.Filter == nil {
+		return source.Search(g, cfg.Keyword, cfg.Scope)
+	}
+	items, err := fs.SearchItems(g, cfg.Keyword, cfg.Scope)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Id != "" && c.Filter(item) {
+			ids = append(ids, item.Id)
+		}
+	}
+	return ids, nil
+}
+
+// get sends a GET request after waiting for the rate limit of the host.
+func (c *Crawler) get(urlstr string) (*http.Response, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return nil, err
+	}
+	c.limiter.wait(u.Host, c.Interval)
+	return c.client.Get(urlstr)
+}
+
+// hostLimiter keeps the interval between the requests to each host.
+type hostLimiter struct {
+	next  map[string]time.Time
+	mutex sync.Mutex
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{
+		next: make(map[string]time.Time),
+	}
+}
+
+func (l *hostLimiter) wait(host string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(interval)
+	l.mutex.Unlock()
+	time.Sleep(at.Sub(now))
+}
+
+func dedupeStrings(list []string) []string {
+	found := make(map[string]bool)
+	deduped := make([]string, 0, len(list))
+	for _, s := range list {
+		if !found[s] {
+			found[s] = true
+			deduped = append(deduped, s)
+		}
+	}
+	return deduped
+}
@@ -0,0 +1,96 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/wcg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCrawlServer(stations map[string]string) (*httptest.Server, *sync.Mutex, *int) {
+	var mutex sync.Mutex
+	var concurrent, maxConcurrent int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/rss/schedulesBySearch.action" {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8" ?><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/">`)
+			for _, id := range []string{"1", "2", "1", "3"} {
+				fmt.Fprintf(w, `<item rdf:about="http://tv.so-net.ne.jp/schedule/%s.action?from=rss"></item>`, id)
+			}
+			fmt.Fprint(w, `</rdf:RDF>`)
+			return
+		}
+		mutex.Lock()
+		concurrent += 1
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		concurrent -= 1
+		mutex.Unlock()
+		id := req.URL.Query().Get("id")
+		station, ok := stations[id]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		io.Copy(w, shiftJIS(fmt.Sprintf(
+			"Content-type: application/x-tv-program-digital-info; charset=shift_jis\r\n"+
+				"version: 2\r\nstation: %s\r\nyear: 2014\r\nmonth: 12\r\ndate: 05\r\n"+
+				"start: 01:00\r\nend: 01:30\r\nprogram-title: 番組%s\r\n\r\n", station, id)))
+	}))
+	return server, &mutex, &maxConcurrent
+}
+
+func TestCrawlConfig(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	server, mutex, maxConcurrent := newTestCrawlServer(map[string]string{
+		"1": "DFS00400",
+		"2": "DFS99999",
+	})
+	defer server.Close()
+
+	crawler := NewCrawler(http.DefaultClient)
+	crawler.Source = NewSoNetSource(server.URL)
+	crawler.Concurrency = 2
+	crawler.Interval = 0
+	crawler.Channels = []*TvChannel{
+		&TvChannel{Cid: "GR4", Sid: "1040", Name: "日本テレビ", IEpgStationId: "DFS00400"},
+	}
+	list, errs := crawler.CrawlConfig(&CrawlerConfig{Keyword: "番組", Category: "test"})
+	assert.EqInt(1, len(list), "CrawlConfig should return the mapped programs.")
+	assert.EqStr("1", list[0].Id, "Id")
+	assert.EqStr("GR4", list[0].Cid, "Cid")
+	assert.EqStr("1040", list[0].Sid, "Sid")
+	assert.EqStr("test", list[0].Category, "Category")
+	assert.EqInt(2, len(errs), "Errors for the unknown station and the missing iEPG.")
+	assert.EqStr("2", errs[0].(*ErrCrawlFailed).Id, "Error for the unknown station")
+	assert.EqStr("3", errs[1].(*ErrCrawlFailed).Id, "Error for the missing iEPG")
+	mutex.Lock()
+	assert.Ok(*maxConcurrent <= 2, "Requests should be bounded by Concurrency.")
+	mutex.Unlock()
+}
+
+func TestCrawlConfig_RateLimit(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	server, _, _ := newTestCrawlServer(map[string]string{
+		"1": "DFS00400", "2": "DFS00400", "3": "DFS00400",
+	})
+	defer server.Close()
+
+	crawler := NewCrawler(http.DefaultClient)
+	crawler.Source = NewSoNetSource(server.URL)
+	crawler.Concurrency = 3
+	crawler.Interval = 50 * time.Millisecond
+	start := time.Now()
+	list, errs := crawler.CrawlConfig(&CrawlerConfig{Keyword: "番組", Category: "test"})
+	assert.Nil(errs, "CrawlConfig should not return errors without Channels.")
+	assert.EqInt(3, len(list), "CrawlConfig should return all programs.")
+	// 1 RSS + 3 iEPG requests to the same host
+	assert.Ok(time.Now().Sub(start) >= 150*time.Millisecond, "Requests should be rate limited per host.")
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/speedland/lib/util"
+	"github.com/speedland/lib/util/jptext"
 	"io"
 	"strings"
 	"time"
@@ -20,29 +21,137 @@ type Epg struct {
 	Sid        string            `json:"sid"`
 	Categories []Category        `json:"category"`
 	ExtDetails map[string]string `json:"extdetail"`
+	Meta       *ProgramMeta      `json:"meta,omitempty"`
 }
 
 type Category struct {
-	Middle string `json:"middle"`
-	Large  string `json:"large"`
+	Middle string     `json:"middle"`
+	Large  string     `json:"large"`
+	Code   *GenreCode `json:"code,omitempty"` // nil if unknown
+}
+
+// Flags returns the ARIB flags in the title.
+func (epg *Epg) Flags() jptext.Flags {
+	_, flags := jptext.ExtractFlags(epg.Title)
+	return flags
+}
+
+// NormalizedTitle returns the normalized title without the ARIB flags.
+func (epg *Epg) NormalizedTitle() string {
+	title, _ := jptext.ExtractFlags(epg.Title)
+	return title
+}
+
+// ExtractMeta extracts the metadata of the program into epg.Meta.
+func (epg *Epg) ExtractMeta() *ProgramMeta {
+	epg.Meta = ExtractProgramMeta(epg.Title, string(epg.Detail), epg.ExtDetails)
+	return epg.Meta
+}
+
+// ToTvRecord returns a new TvRecord to reserve the program.
+func (epg *Epg) ToTvRecord(category string, uid string) *TvRecord {
+	r := NewTvRecord(
+		recordTitle(epg.Title), category,
+		epg.StartAt, epg.EndAt, epg.Cid, epg.Sid, uid,
+	)
+	r.EventId = epg.EventId
+	r.Meta = epg.Meta
+	if r.Meta == nil {
+		r.Meta = epg.ExtractMeta()
+	}
+	return r
+}
+
+// EpgParser parses the JSON generated by epgdump.
+// In lenient mode, broken programs are skipped and reported as errors.
+// In strict mode, any broken program fails the whole document and the
+// time range of each program is also validated.
+type EpgParser struct {
+	Strict bool
+}
+
+func NewEpgParser(strict bool) *EpgParser {
+	return &EpgParser{
+		Strict: strict,
+	}
+}
+
+// epgdump JSON schema
+type epgdumpChannel struct {
+	Id       string            `json:"id"`
+	Name     string            `json:"name"`
+	Programs []json.RawMessage `json:"programs"`
+}
+
+type epgdumpProgram struct {
+	EventId   *int                `json:"event_id"`
+	Channel   *string             `json:"channel"`
+	Title     *string             `json:"title"`
+	Detail    string              `json:"detail"`
+	Start     *int64              `json:"start"`
+	End       *int64              `json:"end"`
+	Category  []*epgdumpCategory  `json:"category"`
+	ExtDetail []*epgdumpExtDetail `json:"extdetail"`
+}
+
+type epgdumpCategory struct {
+	Large  *epgdumpName `json:"large"`
+	Middle *epgdumpName `json:"middle"`
+}
+
+// epgdumpName is the names of a genre, or the numeric ARIB nibble.
+type epgdumpName struct {
+	Ja   string `json:"ja_JP"`
+	En   string `json:"en"`
+	Code *int   `json:"-"`
+}
+
+func (n *epgdumpName) UnmarshalJSON(data []byte) error {
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		n.Code = &code
+		return nil
+	}
+	var name GenreName
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	n.Ja, n.En = name.Ja, name.En
+	return nil
+}
+
+type epgdumpExtDetail struct {
+	Item        string `json:"item"`
+	Description string `json:"item_description"`
 }
 
 func ParseEpgJsonString(jsonstr string) ([]*Epg, []error) {
 	return ParseEpgJson(bytes.NewBuffer([]byte(jsonstr)))
 }
 
+// ParseEpgJson parses the JSON in lenient mode.
 func ParseEpgJson(jsonio io.Reader) ([]*Epg, []error) {
-	var v [](map[string]interface{})
-	err := json.NewDecoder(jsonio).Decode(&v)
-	if err != nil {
-		return nil, []error{err}
-	}
+	return NewEpgParser(false).Parse(jsonio)
+}
+
+// Parse parses all programs of all channels in the document.
+func (p *EpgParser) Parse(jsonio io.Reader) ([]*Epg, []error) {
 	programs := make([]*Epg, 0)
 	elist := make([]error, 0)
-	for _, v := range v[0]["programs"].([]interface{}) {
-		if epg := newEpgFromMap(v.(map[string]interface{}), &elist); epg != nil {
-			programs = append(programs, epg)
+	d := p.NewDecoder(jsonio)
+	for {
+		epg, err := d.Next()
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			if !d.IsFatal(err) {
+				elist = append(elist, err)
+				continue
+			}
+			return nil, []error{err}
+		}
+		programs = append(programs, epg)
 	}
 	if len(elist) > 0 {
 		return programs, elist
@@ -51,53 +160,132 @@ func ParseEpgJson(jsonio io.Reader) ([]*Epg, []error) {
 	}
 }
 
+// ErrEpgParseFailed is an error of a program, which has the source of the
+// program and the path to the field in the document.
 type ErrEpgParseFailed struct {
 	err    error
+	Path   string
 	Source map[string]interface{}
 }
 
 func (e *ErrEpgParseFailed) Error() string {
-	return e.err.Error()
+	return fmt.Sprintf("%s: %v", e.Path, e.err)
+}
+
+func (p *EpgParser) parseProgram(raw json.RawMessage, path string) (*Epg, error) {
+	epg, field, err := p.newEpgFromProgram(raw)
+	if err == nil {
+		return epg, nil
+	}
+	e := &ErrEpgParseFailed{
+		err:  err,
+		Path: path,
+	}
+	if field != "" {
+		e.Path = path + "." + field
+	}
+	json.Unmarshal(raw, &e.Source)
+	return nil, e
 }
 
-func newEpgFromMap(m map[string]interface{}, elist *[]error) *Epg {
-	var epg *Epg
-	defer func() {
-		if v := recover(); v != nil {
-			*elist = append(*elist, &ErrEpgParseFailed{
-				err: fmt.Errorf("%v: %v", v, m),
-			})
+// Returns the Epg or the path to the broken field and the error.
+func (p *EpgParser) newEpgFromProgram(raw json.RawMessage) (*Epg, string, error) {
+	var prog epgdumpProgram
+	if err := json.Unmarshal(raw, &prog); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, te.Field, fmt.Errorf("%s is expected but %s is given", te.Type, te.Value)
 		}
-	}()
-	epg = new(Epg)
-	epg.EventId = int(m["event_id"].(float64))
-	epg.Cid, epg.Sid = parseChannel(m["channel"].(string))
-	epg.Title = m["title"].(string)
-	epg.Detail = []byte(m["detail"].(string))
-	epg.StartAt = time.Unix(int64(m["start"].(float64))/10000, 0)
-	epg.EndAt = time.Unix(int64(m["end"].(float64))/10000, 0)
+		return nil, "", err
+	}
+	if prog.EventId == nil {
+		return nil, "event_id", fmt.Errorf("missing field")
+	}
+	if prog.Channel == nil {
+		return nil, "channel", fmt.Errorf("missing field")
+	}
+	if prog.Title == nil {
+		return nil, "title", fmt.Errorf("missing field")
+	}
+	if prog.Start == nil {
+		return nil, "start", fmt.Errorf("missing field")
+	}
+	if prog.End == nil {
+		return nil, "end", fmt.Errorf("missing field")
+	}
+	epg := new(Epg)
+	epg.EventId = *prog.EventId
+	cid, sid, err := parseChannel(*prog.Channel)
+	if err != nil {
+		return nil, "channel", err
+	}
+	epg.Cid, epg.Sid = cid, sid
+	epg.Title = *prog.Title
+	epg.Detail = []byte(prog.Detail)
+	epg.StartAt = time.Unix(*prog.Start/10000, 0)
+	epg.EndAt = time.Unix(*prog.End/10000, 0)
+	if p.Strict && !epg.StartAt.Before(epg.EndAt) {
+		return nil, "end", fmt.Errorf("end should be after start")
+	}
 	epg.Categories = make([]Category, 0)
-	for _, v := range m["category"].([]interface{}) {
-		c := Category{}
-		if middle, ok := v.(map[string]interface{})["middle"]; ok {
-			c.Middle = middle.(map[string]interface{})["ja_JP"].(string)
+	for _, v := range prog.Category {
+		if v == nil {
+			continue
 		}
-		if large, ok := v.(map[string]interface{})["large"]; ok {
-			c.Large = large.(map[string]interface{})["ja_JP"].(string)
-		}
-		epg.Categories = append(epg.Categories, c)
+		epg.Categories = append(epg.Categories, v.toCategory())
 	}
 	epg.ExtDetails = make(map[string]string)
-	if exts, ok := m["extdetail"]; ok {
-		for _, v := range exts.([]interface{}) {
-			v2 := v.(map[string]interface{})
-			epg.ExtDetails[v2["item"].(string)] = v2["item_description"].(string)
+	for _, v := range prog.ExtDetail {
+		if v != nil {
+			epg.ExtDetails[v.Item] = v.Description
 		}
 	}
-	return epg
+	epg.ExtractMeta()
+	return epg, "", nil
 }
 
-func parseChannel(channel string) (string, string) {
+// toCategory returns the Category with the genre code from the numeric
+// nibbles or the names.
+func (c *epgdumpCategory) toCategory() Category {
+	if c.Large != nil && c.Large.Code != nil {
+		level2 := 0xf
+		if c.Middle != nil && c.Middle.Code != nil {
+			level2 = *c.Middle.Code
+		}
+		if g := NewGenreCode(*c.Large.Code, level2).Genre(); g != nil {
+			return g.Category()
+		}
+	}
+	category := Category{}
+	var large, middle GenreName
+	if c.Middle != nil {
+		category.Middle = c.Middle.Ja
+		middle = GenreName{c.Middle.Ja, c.Middle.En}
+	}
+	if c.Large != nil {
+		category.Large = c.Large.Ja
+		large = GenreName{c.Large.Ja, c.Large.En}
+	}
+	g, ok := LookupGenre(large.Ja, middle.Ja)
+	if !ok {
+		g, ok = LookupGenre(large.En, middle.En)
+	}
+	if ok {
+		category.Code = &g.Code
+	}
+	return category
+}
+
+// recordTitle returns the title which can be a part of file names. The
+// width is kept as NFKC turns full-width symbols into InvalidChars; the
+// normalized title is only for searching and matching.
+func recordTitle(title string) string {
+	return strings.Replace(title, "/", "／", -1)
+}
+
+func parseChannel(channel string) (string, string, error) {
 	s := strings.Split(channel, "_")
-	return s[0], s[1]
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", "", fmt.Errorf("invalid channel %q", channel)
+	}
+	return s[0], s[1], nil
 }
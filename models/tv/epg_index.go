@@ -0,0 +1,217 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util/jptext"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EpgIndex is an in-memory index of programs, which are stored per channel
+// and sorted by StartAt. Channels are identified by "{Cid}.{Sid}" as
+// TvChannel.Key(). Programs on the same channel are assumed not to overlap.
+type EpgIndex struct {
+	channels map[string][]*Epg
+	texts    map[*Epg]string
+	mutex    sync.RWMutex
+}
+
+func NewEpgIndex(epgs []*Epg) *EpgIndex {
+	idx := &EpgIndex{
+		channels: make(map[string][]*Epg),
+		texts:    make(map[*Epg]string),
+	}
+	idx.Add(epgs...)
+	return idx
+}
+
+func epgChannelKey(epg *Epg) string {
+	return fmt.Sprintf("%s.%s", epg.Cid, epg.Sid)
+}
+
+// Add adds the programs. A program replaces the indexed one which has the
+// same EventId on the same channel.
+func (idx *EpgIndex) Add(epgs ...*Epg) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	updated := make(map[string]bool)
+	for _, epg := range epgs {
+		key := epgChannelKey(epg)
+		list := idx.channels[key]
+		replaced := false
+		if epg.EventId != 0 {
+			for i, e := range list {
+				if e.EventId == epg.EventId {
+					delete(idx.texts, e)
+					list[i] = epg
+					replaced = true
+					break
+				}
+			}
+		}
+		if !replaced {
+			list = append(list, epg)
+		}
+		idx.channels[key] = list
+		idx.texts[epg] = searchText(epg)
+		updated[key] = true
+	}
+	for key := range updated {
+		list := idx.channels[key]
+		sort.Stable(epgsByStartAt(list))
+	}
+}
+
+// Len returns the number of the indexed programs.
+func (idx *EpgIndex) Len() int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return len(idx.texts)
+}
+
+// Channels returns the keys of the indexed channels.
+func (idx *EpgIndex) Channels() []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	keys := make([]string, 0, len(idx.channels))
+	for key := range idx.channels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// OnAir returns the program on the channel at t, or nil.
+func (idx *EpgIndex) OnAir(channel string, t time.Time) *Epg {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	list := idx.channels[channel]
+	i := sort.Search(len(list), func(i int) bool { return list[i].StartAt.After(t) })
+	if i > 0 && list[i-1].EndAt.After(t) {
+		return list[i-1]
+	}
+	return nil
+}
+
+// Next returns the first program on the channel which starts after t, or nil.
+func (idx *EpgIndex) Next(channel string, t time.Time) *Epg {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	list := idx.channels[channel]
+	i := sort.Search(len(list), func(i int) bool { return list[i].StartAt.After(t) })
+	if i < len(list) {
+		return list[i]
+	}
+	return nil
+}
+
+// NowOnAir returns the programs on all channels at t.
+func (idx *EpgIndex) NowOnAir(t time.Time) []*Epg {
+	list := make([]*Epg, 0)
+	for _, key := range idx.Channels() {
+		if epg := idx.OnAir(key, t); epg != nil {
+			list = append(list, epg)
+		}
+	}
+	return list
+}
+
+// Range returns the programs which start in [from, to).
+// All channels are queried if channel is empty.
+func (idx *EpgIndex) Range(channel string, from time.Time, to time.Time) []*Epg {
+	return idx.query(channel, func(list []*Epg) []*Epg {
+		lo := sort.Search(len(list), func(i int) bool { return !list[i].StartAt.Before(from) })
+		hi := sort.Search(len(list), func(i int) bool { return !list[i].StartAt.Before(to) })
+		return list[lo:hi]
+	})
+}
+
+// Overlap returns the programs which are on air in [from, to).
+// All channels are queried if channel is empty.
+func (idx *EpgIndex) Overlap(channel string, from time.Time, to time.Time) []*Epg {
+	return idx.query(channel, func(list []*Epg) []*Epg {
+		lo := sort.Search(len(list), func(i int) bool { return list[i].EndAt.After(from) })
+		hi := sort.Search(len(list), func(i int) bool { return !list[i].StartAt.Before(to) })
+		if lo >= hi {
+			return nil
+		}
+		return list[lo:hi]
+	})
+}
+
+// Search returns the programs which contain all words in the query in
+// Title, Detail or ExtDetails. The texts are compared after folded by
+// jptext.Fold, so that "第3話" matches "#3".
+func (idx *EpgIndex) Search(query string) []*Epg {
+	words := strings.Fields(jptext.Fold(query))
+	return idx.filter(func(epg *Epg, text string) bool {
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// FilterByCategory returns the programs which have the category.
+// Empty large or middle matches any.
+func (idx *EpgIndex) FilterByCategory(large string, middle string) []*Epg {
+	return idx.filter(func(epg *Epg, text string) bool {
+		for _, c := range epg.Categories {
+			if (large == "" || c.Large == large) && (middle == "" || c.Middle == middle) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (idx *EpgIndex) query(channel string, fn func([]*Epg) []*Epg) []*Epg {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	list := make([]*Epg, 0)
+	if channel != "" {
+		return append(list, fn(idx.channels[channel])...)
+	}
+	for _, epgs := range idx.channels {
+		list = append(list, fn(epgs)...)
+	}
+	sort.Sort(epgsByStartAt(list))
+	return list
+}
+
+func (idx *EpgIndex) filter(fn func(*Epg, string) bool) []*Epg {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	list := make([]*Epg, 0)
+	for epg, text := range idx.texts {
+		if fn(epg, text) {
+			list = append(list, epg)
+		}
+	}
+	sort.Sort(epgsByStartAt(list))
+	return list
+}
+
+// Programs are sorted by StartAt and the channel.
+type epgsByStartAt []*Epg
+
+func (l epgsByStartAt) Len() int      { return len(l) }
+func (l epgsByStartAt) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l epgsByStartAt) Less(i, j int) bool {
+	if l[i].StartAt.Equal(l[j].StartAt) {
+		return epgChannelKey(l[i]) < epgChannelKey(l[j])
+	}
+	return l[i].StartAt.Before(l[j].StartAt)
+}
+
+func searchText(epg *Epg) string {
+	texts := []string{epg.Title, string(epg.Detail)}
+	for k, v := range epg.ExtDetails {
+		texts = append(texts, k, v)
+	}
+	return jptext.Fold(strings.Join(texts, "\n"))
+}
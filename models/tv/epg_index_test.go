@@ -0,0 +1,49 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+	"time"
+)
+
+func TestEpgIndex_Time(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	epgs := genTestEpgs()
+	base := time.Date(2014, 12, 5, 0, 0, 0, 0, jst)
+	idx := NewEpgIndex([]*Epg{epgs[2], epgs[1], epgs[0]})
+	assert.EqInt(3, idx.Len(), "Len")
+	assert.EqInt(2, len(idx.Channels()), "Channels")
+
+	assert.EqInt(1, idx.OnAir("GR7.1072", base.Add(70*time.Minute)).EventId, "OnAir")
+	assert.Ok(idx.OnAir("GR7.1072", base.Add(2*time.Hour)) == nil, "OnAir between programs")
+	assert.EqInt(2, idx.Next("GR7.1072", base.Add(70*time.Minute)).EventId, "Next")
+	assert.Ok(idx.Next("GR7.1072", base.Add(14*time.Hour)) == nil, "Next after the last program")
+	assert.EqInt(1, len(idx.NowOnAir(base.Add(18*time.Hour+30*time.Minute))), "NowOnAir")
+
+	list := idx.Range("", base, base.Add(18*time.Hour))
+	assert.EqInt(2, len(list), "Range should not include the program starting at the end.")
+	assert.EqInt(1, list[0].EventId, "Range should be sorted by StartAt.")
+	list = idx.Overlap("", base.Add(80*time.Minute), base.Add(18*time.Hour+1))
+	assert.EqInt(3, len(list), "Overlap")
+	list = idx.Overlap("GR7.1072", base.Add(90*time.Minute), base.Add(13*time.Hour))
+	assert.EqInt(0, len(list), "Overlap should not include the programs touching the range.")
+
+	// replace by EventId
+	moved := *epgs[1]
+	moved.StartAt = base.Add(12 * time.Hour)
+	idx.Add(&moved)
+	assert.EqInt(3, idx.Len(), "Programs with the same EventId should be replaced.")
+	assert.EqInt(2, idx.OnAir("GR7.1072", base.Add(12*time.Hour)).EventId, "OnAir after replaced")
+}
+
+func TestEpgIndex_Search(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	idx := NewEpgIndex(genTestEpgs())
+	assert.EqInt(2, len(idx.Search("girls")), "Search should fold the case.")
+	assert.EqInt(2, len(idx.Search("ＬＩＶＥ")), "Search should fold the width.")
+	assert.EqInt(2, len(idx.Search("モーニング娘")), "Search should match Detail and ExtDetails.")
+	assert.EqInt(1, len(idx.Search("girls 卒業")), "All words should be matched.")
+	assert.EqInt(2, len(idx.FilterByCategory("音楽", "")), "FilterByCategory by Large")
+	assert.EqInt(1, len(idx.FilterByCategory("", "定時・総合")), "FilterByCategory by Middle")
+	assert.EqInt(0, len(idx.FilterByCategory("音楽", "定時・総合")), "FilterByCategory by Large and Middle")
+}
@@ -0,0 +1,246 @@
+package tv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// EpgDecoder decodes the epgdump JSON token by token and yields the
+// programs one at a time, so that only one program is held in memory.
+type EpgDecoder struct {
+	parser      *EpgParser
+	dec         *json.Decoder
+	started     bool
+	inChannel   bool
+	inPrograms  bool
+	channel     int
+	program     int
+	channelId   string
+	channelName string
+	raw         json.RawMessage
+	err         error
+}
+
+// NewDecoder returns a decoder which parses the programs by the parser settings.
+func (p *EpgParser) NewDecoder(jsonio io.Reader) *EpgDecoder {
+	return &EpgDecoder{
+		parser:  p,
+		dec:     json.NewDecoder(jsonio),
+		channel: -1,
+	}
+}
+
+// Next returns the next program, or io.EOF at the end of the document.
+// A broken program is returned as *ErrEpgParseFailed and the decoder can
+// continue unless it is in strict mode. Use IsFatal to check if the
+// decoder can continue after the error.
+func (d *EpgDecoder) Next() (*Epg, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	epg, err := d.next()
+	if err != nil && d.IsFatal(err) {
+		d.err = err
+	}
+	return epg, err
+}
+
+// IsFatal returns true if the error returned by Next stops the decoding.
+func (d *EpgDecoder) IsFatal(err error) bool {
+	if _, ok := err.(*ErrEpgParseFailed); ok {
+		return d.parser.Strict
+	}
+	return true
+}
+
+// Raw returns the source of the last program returned by Next.
+func (d *EpgDecoder) Raw() json.RawMessage {
+	return d.raw
+}
+
+// Channel returns the id and the name of the channel of the last program.
+// They are available only if they precede "programs" in the document.
+func (d *EpgDecoder) Channel() (string, string) {
+	return d.channelId, d.channelName
+}
+
+func (d *EpgDecoder) next() (*Epg, error) {
+	if !d.started {
+		if err := d.expect(json.Delim('[')); err != nil {
+			return nil, err
+		}
+		d.started = true
+	}
+	for {
+		switch {
+		case d.inPrograms:
+			if !d.dec.More() {
+				if err := d.expect(json.Delim(']')); err != nil {
+					return nil, err
+				}
+				d.inPrograms = false
+				continue
+			}
+			d.program += 1
+			d.raw = nil
+			if err := d.dec.Decode(&d.raw); err != nil {
+				return nil, err
+			}
+			return d.parser.parseProgram(d.raw, fmt.Sprintf("[%d].programs[%d]", d.channel, d.program))
+		case d.inChannel:
+			if !d.dec.More() {
+				if err := d.expect(json.Delim('}')); err != nil {
+					return nil, err
+				}
+				d.inChannel = false
+				continue
+			}
+			if err := d.field(); err != nil {
+				return nil, err
+			}
+		default:
+			if !d.dec.More() {
+				if err := d.expect(json.Delim(']')); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			d.channel += 1
+			tok, err := d.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			if tok == nil {
+				continue
+			}
+			if tok != json.Delim('{') {
+				return nil, fmt.Errorf("[%d]: channel object is expected but %v is given", d.channel, tok)
+			}
+			d.inChannel = true
+			d.channelId, d.channelName = "", ""
+		}
+	}
+}
+
+// field reads a field of the channel object.
+func (d *EpgDecoder) field() error {
+	tok, err := d.dec.Token()
+	if err != nil {
+		return err
+	}
+	key, _ := tok.(string)
+	if key == "programs" {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			return nil
+		}
+		if tok != json.Delim('[') {
+			return fmt.Errorf("[%d].programs: array is expected but %v is given", d.channel, tok)
+		}
+		d.inPrograms = true
+		d.program = -1
+		return nil
+	}
+	var value json.RawMessage
+	if err := d.dec.Decode(&value); err != nil {
+		return err
+	}
+	switch key {
+	case "id":
+		json.Unmarshal(value, &d.channelId)
+	case "name":
+		json.Unmarshal(value, &d.channelName)
+	}
+	return nil
+}
+
+func (d *EpgDecoder) expect(delim json.Delim) error {
+	tok, err := d.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("%v is expected but %v is given", delim, tok)
+	}
+	return nil
+}
+
+// Stream calls fn for each program in the document. It stops when fn
+// returns an error, and returns the errors of the broken programs and fn.
+func (p *EpgParser) Stream(jsonio io.Reader, fn func(*Epg) error) []error {
+	return p.NewDecoder(jsonio).Each(fn)
+}
+
+// Each calls fn for each remaining program as Stream does.
+func (d *EpgDecoder) Each(fn func(*Epg) error) []error {
+	elist := make([]error, 0)
+	for {
+		epg, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			elist = append(elist, err)
+			if d.IsFatal(err) {
+				break
+			}
+			continue
+		}
+		if err := fn(epg); err != nil {
+			elist = append(elist, err)
+			break
+		}
+	}
+	if len(elist) > 0 {
+		return elist
+	}
+	return nil
+}
+
+// SplitEpgJson splits the epgdump JSON into the documents in the same format,
+// each of which has a channel with up to `size` programs, and calls fn with
+// them. Broken programs are not included and returned as errors.
+// The last batch is not passed if the document is not read to the end.
+func (p *EpgParser) SplitEpgJson(jsonio io.Reader, size int, fn func(batch []byte) error) []error {
+	var batch *epgdumpChannel
+	channel := -1
+	flush := func() error {
+		if batch == nil || len(batch.Programs) == 0 {
+			return nil
+		}
+		buff, err := json.Marshal([]*epgdumpChannel{batch})
+		if err != nil {
+			return err
+		}
+		batch.Programs = make([]json.RawMessage, 0, size)
+		return fn(buff)
+	}
+	d := p.NewDecoder(jsonio)
+	elist := d.Each(func(epg *Epg) error {
+		if batch == nil || channel != d.channel || len(batch.Programs) >= size {
+			if err := flush(); err != nil {
+				return err
+			}
+			id, name := d.Channel()
+			batch = &epgdumpChannel{
+				Id:       id,
+				Name:     name,
+				Programs: make([]json.RawMessage, 0, size),
+			}
+			channel = d.channel
+		}
+		batch.Programs = append(batch.Programs, d.Raw())
+		return nil
+	})
+	if d.err != io.EOF {
+		return elist
+	}
+	if err := flush(); err != nil {
+		elist = append(elist, err)
+	}
+	return elist
+}
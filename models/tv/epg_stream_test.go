@@ -0,0 +1,121 @@
+package tv
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/speedland/wcg"
+	"io"
+	"testing"
+)
+
+func TestEpgDecoder(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	d := NewEpgParser(false).NewDecoder(bytes.NewBufferString(testStreamJson))
+	epg, err := d.Next()
+	assert.Nil(err, "Next should not return an error.")
+	assert.EqInt(1, epg.EventId, "EventId of the 1st program")
+	id, name := d.Channel()
+	assert.EqStr("GR5_1064", id, "Channel id")
+	assert.EqStr("GR5", name, "Channel name")
+	assert.Ok(bytes.Contains(d.Raw(), []byte(`"event_id": 1`)), "Raw should be the source of the program.")
+
+	_, err = d.Next()
+	assert.NotNil(err, "Next should return an error for the broken program.")
+	assert.Ok(!d.IsFatal(err), "The error should not be fatal in lenient mode.")
+
+	epg, err = d.Next()
+	assert.Nil(err, "Next should continue after the broken program.")
+	assert.EqInt(3, epg.EventId, "EventId of the program in the 2nd channel")
+	id, _ = d.Channel()
+	assert.EqStr("BS15_0", id, "Channel id of the 2nd channel")
+
+	_, err = d.Next()
+	assert.Ok(err == io.EOF, "Next should return io.EOF at the end.")
+
+	d = NewEpgParser(true).NewDecoder(bytes.NewBufferString(testStreamJson))
+	d.Next()
+	_, err = d.Next()
+	assert.Ok(d.IsFatal(err), "The error should be fatal in strict mode.")
+	_, err2 := d.Next()
+	assert.Ok(err == err2, "Next should keep returning the fatal error.")
+
+	_, errs := ParseEpgJsonString(`[{"programs": [{"event_id": 1,`)
+	assert.EqInt(1, len(errs), "Truncated document should fail.")
+}
+
+func TestEpgParser_Stream(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	count := 0
+	errs := NewEpgParser(false).Stream(bytes.NewBufferString(testStreamJson), func(epg *Epg) error {
+		count += 1
+		return nil
+	})
+	assert.EqInt(2, count, "Stream should call fn for valid programs.")
+	assert.EqInt(1, len(errs), "Stream should return the errors of broken programs.")
+}
+
+func TestEpgParser_SplitEpgJson(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	batches := make([][]*epgdumpChannel, 0)
+	errs := NewEpgParser(false).SplitEpgJson(bytes.NewBufferString(testSplitJson), 2, func(batch []byte) error {
+		var doc []*epgdumpChannel
+		if err := json.Unmarshal(batch, &doc); err != nil {
+			return err
+		}
+		batches = append(batches, doc)
+		return nil
+	})
+	assert.Nil(errs, "SplitEpgJson should not return errors.")
+	assert.EqInt(3, len(batches), "Programs should be split by the size and the channel.")
+	assert.EqInt(2, len(batches[0][0].Programs), "1st batch")
+	assert.EqStr("GR5_1064", batches[0][0].Id, "Channel id of the 1st batch")
+	assert.EqInt(1, len(batches[1][0].Programs), "2nd batch")
+	assert.EqInt(1, len(batches[2][0].Programs), "3rd batch")
+	assert.EqStr("BS15_0", batches[2][0].Id, "Channel id of the 3rd batch")
+
+	list, _ := ParseEpgJson(bytes.NewBuffer(mustMarshal(batches[2])))
+	assert.EqInt(4, list[0].EventId, "The batch should be a valid epgdump JSON.")
+}
+
+func mustMarshal(v interface{}) []byte {
+	buff, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return buff
+}
+
+var testStreamJson = `
+[{
+  "id": "GR5_1064", "name": "GR5",
+  "programs": [{
+    "event_id": 1, "channel": "GR5_1064", "title": "a",
+    "start": 14010548400000, "end": 14010550800000
+  }, {
+    "event_id": 2, "channel": "GR5_1064",
+    "start": 14010548400000, "end": 14010550800000
+  }]
+}, null, {
+  "id": "BS15_0", "name": "BS15", "extra": {"nested": [1, 2]},
+  "programs": [{
+    "event_id": 3, "channel": "BS15_0", "title": "c",
+    "start": 14010548400000, "end": 14010550800000
+  }]
+}]
+`
+
+var testSplitJson = `
+[{
+  "id": "GR5_1064",
+  "programs": [
+    {"event_id": 1, "channel": "GR5_1064", "title": "a", "start": 14010548400000, "end": 14010550800000},
+    {"event_id": 2, "channel": "GR5_1064", "title": "b", "start": 14010548400000, "end": 14010550800000},
+    {"event_id": 3, "channel": "GR5_1064", "title": "c", "start": 14010548400000, "end": 14010550800000}
+  ]
+}, {
+  "id": "BS15_0",
+  "programs": [
+    {"event_id": 4, "channel": "BS15_0", "title": "d", "start": 14010548400000, "end": 14010550800000}
+  ]
+}]
+`
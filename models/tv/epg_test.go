@@ -1,8 +1,10 @@
 package tv
 
 import (
+	"bytes"
 	"github.com/speedland/wcg"
 	"testing"
+	"time"
 )
 
 func TestParseEpgJson(t *testing.T) {
@@ -62,3 +64,78 @@ var testJson = `
   }]
 }]
 `
+
+func TestParseEpgJson_MultipleChannels(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	list, err := ParseEpgJsonString(testMultiChannelJson)
+	assert.NotNil(err, "ParseEpgJson should return errors for broken programs.")
+	assert.EqInt(2, len(list), "Valid programs in all channels should be returned.")
+	assert.EqStr("GR5", list[0].Cid, "Cid of the 1st channel")
+	assert.EqStr("BS15", list[1].Cid, "Cid of the 2nd channel")
+	assert.EqInt(2, len(err), "Errors for each broken program.")
+
+	e := err[0].(*ErrEpgParseFailed)
+	assert.EqStr("[0].programs[1].title", e.Path, "Path of the missing field")
+	assert.EqStr("broken", e.Source["channel"].(string), "Source of the broken program")
+	e = err[1].(*ErrEpgParseFailed)
+	assert.EqStr("[1].programs[1].start", e.Path, "Path of the type mismatch")
+}
+
+func TestParseEpgJson_Strict(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	list, err := NewEpgParser(true).Parse(bytes.NewBufferString(testMultiChannelJson))
+	assert.Ok(list == nil, "Strict parser should not return programs.")
+	assert.EqInt(1, len(err), "Strict parser should return the first error.")
+
+	_, err = NewEpgParser(true).Parse(bytes.NewBufferString(`[{"programs": [
+	  {"event_id": 1, "channel": "GR5_1064", "title": "a", "start": 14010550800000, "end": 14010548400000}
+	]}]`))
+	assert.NotNil(err, "Strict parser should validate the time range.")
+
+	_, err = ParseEpgJsonString(`{"programs": []}`)
+	assert.NotNil(err, "ParseEpgJson should return an error for non-array document.")
+}
+
+var testMultiChannelJson = `
+[{
+  "id": "GR5_1064",
+  "programs": [{
+    "event_id": 1, "channel": "GR5_1064", "title": "valid", "detail": "",
+    "start": 14010548400000, "end": 14010550800000, "category": [], "extdetail": []
+  }, {
+    "event_id": 2, "channel": "broken",
+    "start": 14010548400000, "end": 14010550800000
+  }]
+}, {
+  "id": "BS15_0",
+  "programs": [{
+    "event_id": 3, "channel": "BS15_0", "title": "valid",
+    "start": 14010548400000, "end": 14010550800000
+  }, {
+    "event_id": 4, "channel": "BS15_0", "title": "broken",
+    "start": "14010548400000", "end": 14010550800000
+  }]
+}]
+`
+
+func TestEpg_Flags(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	epg := &Epg{Title: "ＡＮＮニュース/天気【字】【再】"}
+	flags := epg.Flags()
+	assert.Ok(flags.Subtitled && flags.Rerun, "Flags")
+	assert.Ok(!flags.New && !flags.Final && !flags.DataBroadcast, "Flags")
+	assert.EqStr("ANNニュース/天気", epg.NormalizedTitle(), "NormalizedTitle")
+	assert.EqStr("ＡＮＮニュース／天気【字】【再】", epg.ToTvRecord("news", "me").Title, "Title of the record")
+}
+
+func TestEpg_ToTvRecord_FullWidthSymbols(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	for _, title := range []string{"ドラマ＃１２", "トム＆ジェリー"} {
+		epg := &Epg{Title: title, Cid: "GR4", Sid: "1040", StartAt: time.Now(), EndAt: time.Now().Add(30 * time.Minute)}
+		r := epg.ToTvRecord("etc", "me")
+		assert.EqStr(title, r.Title, "Full-width symbols should be kept.")
+		assert.Nil(RecordValidator.Eval(r), "Title with full-width symbols should be valid.")
+		iepg := &IEpg{ProgramTitle: title, StartAt: r.StartAt, EndAt: r.EndAt}
+		assert.EqStr(title, iepg.ToTvRecord().Title, "Full-width symbols should be kept in iEPG.")
+	}
+}
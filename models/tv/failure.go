@@ -0,0 +1,136 @@
+package tv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// FailureReason classifies why a recording could not be done.
+type FailureReason int
+
+var (
+	FRUnknown       = FailureReason(0)
+	FRTunerBusy     = FailureReason(1)
+	FRDeviceMissing = FailureReason(2)
+	FRSignalLost    = FailureReason(3)
+	FRDiskFull      = FailureReason(4)
+	FRNotStarted    = FailureReason(5)
+)
+
+func (r FailureReason) String() string {
+	switch r {
+	case FRTunerBusy:
+		return "tuner busy"
+	case FRDeviceMissing:
+		return "device missing"
+	case FRSignalLost:
+		return "signal lost"
+	case FRDiskFull:
+		return "disk full"
+	case FRNotStarted:
+		return "not started"
+	default:
+		return "unknown"
+	}
+}
+
+// Fatal reasons are not recovered by restarting the recording.
+func (r FailureReason) IsFatal() bool {
+	return r == FRDeviceMissing || r == FRDiskFull
+}
+
+// ErrRecordFailed is an error with the classified reason.
+type ErrRecordFailed struct {
+	Reason FailureReason
+	Err    error
+}
+
+func (e *ErrRecordFailed) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Recording failed (%s)", e.Reason)
+	}
+	return fmt.Sprintf("Recording failed (%s): %v", e.Reason, e.Err)
+}
+
+func (e *ErrRecordFailed) FailureReason() FailureReason {
+	return e.Reason
+}
+
+// ErrDegraded is returned when the record can be started but may not be
+// recorded completely, e.g. by StorageManager in Degrade mode.
+type ErrDegraded struct {
+	Reason FailureReason
+	Err    error
+}
+
+func (e *ErrDegraded) Error() string {
+	return fmt.Sprintf("Recording degraded (%s): %v", e.Reason, e.Err)
+}
+
+func (e *ErrDegraded) FailureReason() FailureReason {
+	return e.Reason
+}
+
+// ClassifiedError can be implemented by errors returned from Record
+// implementations to tell the reason explicitly.
+type ClassifiedError interface {
+	FailureReason() FailureReason
+}
+
+// Path prefix of the tuner devices. A missing file under this path means
+// the device is missing, otherwise it is just a missing file.
+var DevicePathPrefix = "/dev/"
+
+// recpt1 messages (lower case) and the reasons they mean. Messages with
+// device are matched only if they mention DevicePathPrefix.
+var failureMessages = []struct {
+	message string
+	device  bool
+	reason  FailureReason
+}{
+	{"no space left on device", false, FRDiskFull},
+	{"device or resource busy", false, FRTunerBusy},
+	{"tuner is busy", false, FRTunerBusy},
+	{"cannot tune", false, FRTunerBusy},
+	{"cannot open tuner", false, FRTunerBusy},
+	{"no such device", true, FRDeviceMissing},
+	{"no such file or directory", true, FRDeviceMissing},
+	{"signal strength", false, FRSignalLost},
+	{"signal lost", false, FRSignalLost},
+	{"c/n = ", false, FRSignalLost},
+}
+
+// ClassifyFailure returns the reason of err returned by a Record.
+func ClassifyFailure(err error) FailureReason {
+	if err == nil {
+		return FRUnknown
+	}
+	if ce, ok := err.(ClassifiedError); ok {
+		return ce.FailureReason()
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		switch pe.Err {
+		case syscall.ENOSPC:
+			return FRDiskFull
+		case syscall.EBUSY:
+			return FRTunerBusy
+		case syscall.ENOENT, syscall.ENODEV:
+			if strings.HasPrefix(pe.Path, DevicePathPrefix) {
+				return FRDeviceMissing
+			}
+			return FRUnknown
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range failureMessages {
+		if m.device && !strings.Contains(msg, DevicePathPrefix) {
+			continue
+		}
+		if strings.Contains(msg, m.message) {
+			return m.reason
+		}
+	}
+	return FRUnknown
+}
@@ -0,0 +1,274 @@
+package tv
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FeedItem is an item of the RSS 1.0, RSS 2.0 or Atom feed of programs.
+// The fields after Id are extracted from the so-net feed and empty for
+// other feeds.
+type FeedItem struct {
+	Title       string    `json:"title"`
+	Link        string    `json:"link"`
+	Description string    `json:"description"`
+	Date        time.Time `json:"date"`
+	Subjects    []string  `json:"subjects"`
+	Id          string    `json:"id"`       // iEPG id
+	Station     string    `json:"station"`  // station name in the description
+	StartAt     time.Time `json:"start_at"` // broadcast time in the description
+	EndAt       time.Time `json:"end_at"`
+	Sid         string    `json:"sid"`      // service id in dc:relation
+	EventId     int       `json:"event_id"` // event id in dc:relation
+}
+
+const (
+	nsRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC  = "http://purl.org/dc/elements/1.1/"
+)
+
+// RSS 1.0
+type rss1Item struct {
+	About       string   `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# about,attr"`
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	Date        string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Subjects    []string `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Relation    string   `xml:"http://purl.org/dc/elements/1.1/ relation"`
+}
+
+type rss1Doc struct {
+	Items []*rss1Item `xml:"item"`
+}
+
+// RSS 2.0
+type rss2Item struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	PubDate     string   `xml:"pubDate"`
+	Date        string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Guid        string   `xml:"guid"`
+	Categories  []string `xml:"category"`
+}
+
+type rss2Doc struct {
+	Items []*rss2Item `xml:"channel>item"`
+}
+
+// Atom
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Id         string          `xml:"id"`
+	Title      string          `xml:"title"`
+	Links      []*atomLink     `xml:"link"`
+	Summary    string          `xml:"summary"`
+	Content    string          `xml:"content"`
+	Published  string          `xml:"published"`
+	Updated    string          `xml:"updated"`
+	Categories []*atomCategory `xml:"category"`
+}
+
+type atomDoc struct {
+	Entries []*atomEntry `xml:"entry"`
+}
+
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+}
+
+// ParseFeed parses the RSS 1.0 (RDF), RSS 2.0 or Atom feed.
+func ParseFeed(r io.Reader) ([]*FeedItem, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = xmltvCharsetReader
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse feed: %v", err)
+		}
+		root, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch root.Name.Local {
+		case "RDF":
+			var doc rss1Doc
+			if err := decoder.DecodeElement(&doc, &root); err != nil {
+				return nil, fmt.Errorf("Could not parse RSS 1.0 feed: %v", err)
+			}
+			return doc.items(), nil
+		case "rss":
+			var doc rss2Doc
+			if err := decoder.DecodeElement(&doc, &root); err != nil {
+				return nil, fmt.Errorf("Could not parse RSS 2.0 feed: %v", err)
+			}
+			return doc.items(), nil
+		case "feed":
+			var doc atomDoc
+			if err := decoder.DecodeElement(&doc, &root); err != nil {
+				return nil, fmt.Errorf("Could not parse Atom feed: %v", err)
+			}
+			return doc.items(), nil
+		default:
+			return nil, fmt.Errorf("Unknown feed format <%s>", root.Name.Local)
+		}
+	}
+}
+
+func (doc *rss1Doc) items() []*FeedItem {
+	list := make([]*FeedItem, 0, len(doc.Items))
+	for _, i := range doc.Items {
+		item := &FeedItem{
+			Title:       strings.TrimSpace(i.Title),
+			Link:        strings.TrimSpace(i.Link),
+			Description: strings.TrimSpace(i.Description),
+			Date:        parseFeedTime(i.Date),
+			Subjects:    splitFeedSubjects(i.Subjects),
+		}
+		item.fill(i.About, i.Relation)
+		list = append(list, item)
+	}
+	return list
+}
+
+func (doc *rss2Doc) items() []*FeedItem {
+	list := make([]*FeedItem, 0, len(doc.Items))
+	for _, i := range doc.Items {
+		item := &FeedItem{
+			Title:       strings.TrimSpace(i.Title),
+			Link:        strings.TrimSpace(i.Link),
+			Description: strings.TrimSpace(i.Description),
+			Date:        parseFeedTime(i.PubDate),
+			Subjects:    splitFeedSubjects(i.Categories),
+		}
+		if item.Date.IsZero() {
+			item.Date = parseFeedTime(i.Date)
+		}
+		url := item.Link
+		if url == "" {
+			url = i.Guid
+		}
+		item.fill(url, "")
+		list = append(list, item)
+	}
+	return list
+}
+
+func (doc *atomDoc) items() []*FeedItem {
+	list := make([]*FeedItem, 0, len(doc.Entries))
+	for _, e := range doc.Entries {
+		item := &FeedItem{
+			Title:       strings.TrimSpace(e.Title),
+			Description: strings.TrimSpace(e.Summary),
+			Date:        parseFeedTime(e.Published),
+			Subjects:    make([]string, 0),
+		}
+		if item.Description == "" {
+			item.Description = strings.TrimSpace(e.Content)
+		}
+		if item.Date.IsZero() {
+			item.Date = parseFeedTime(e.Updated)
+		}
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				item.Link = l.Href
+				break
+			}
+		}
+		for _, c := range e.Categories {
+			item.Subjects = append(item.Subjects, c.Term)
+		}
+		url := item.Link
+		if url == "" {
+			url = e.Id
+		}
+		item.fill(url, "")
+		list = append(list, item)
+	}
+	return list
+}
+
+// The year of the broadcast time is taken from the date of the item, and
+// moved to the next (or previous) year if the time is more than this before
+// (or after) the date.
+const feedYearRolloverWindow = 183 * 24 * time.Hour
+
+// so-net description like "12/5 1:00～1:30 [テレビ東京(Ch.7)]"
+var feedDescriptionRegexp = regexp.MustCompile(`(\d+)/(\d+)\s+(\d+):(\d+)\s*[～~〜-]\s*(\d+):(\d+)\s*\[(.+?)(?:\(Ch\.\d+\))?\]`)
+
+// fill extracts the fields from the url, the description and the relation.
+func (item *FeedItem) fill(url string, relation string) {
+	item.Id = extractIdFromUrl(url)
+	if m := feedDescriptionRegexp.FindStringSubmatch(item.Description); m != nil {
+		item.Station = strings.TrimSpace(m[7])
+		var n [6]int
+		for i := range n {
+			n[i], _ = strconv.Atoi(m[i+1])
+		}
+		year := item.Date.In(jst).Year()
+		if item.Date.IsZero() {
+			year = time.Now().In(jst).Year()
+		}
+		item.StartAt = time.Date(year, time.Month(n[0]), n[1], n[2], n[3], 0, 0, jst)
+		// the programs in January in a feed dated December, and vice versa.
+		if !item.Date.IsZero() {
+			if d := item.StartAt.Sub(item.Date); d < -feedYearRolloverWindow {
+				year += 1
+			} else if d > feedYearRolloverWindow {
+				year -= 1
+			}
+			item.StartAt = time.Date(year, time.Month(n[0]), n[1], n[2], n[3], 0, 0, jst)
+		}
+		item.EndAt = time.Date(year, time.Month(n[0]), n[1], n[4], n[5], 0, 0, jst)
+		if !item.EndAt.After(item.StartAt) {
+			item.EndAt = item.EndAt.AddDate(0, 0, 1)
+		}
+	}
+	// network id:service id:event id
+	if ids := strings.Split(strings.TrimSpace(relation), ":"); len(ids) == 3 {
+		item.Sid = ids[1]
+		item.EventId, _ = strconv.Atoi(ids[2])
+	}
+}
+
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Subjects may be separated by commas in an element.
+func splitFeedSubjects(values []string) []string {
+	list := make([]string, 0)
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,130 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFeed_RSS1(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	file, _ := os.Open("./iepg-feed-sample.html")
+	defer file.Close()
+	items, err := ParseFeed(file)
+	assert.Nil(err, "ParseFeed should not return an error.")
+	assert.EqInt(6, len(items), "ParseFeed should return all items.")
+
+	item := items[0]
+	assert.EqStr("101072201412050100", item.Id, "Id")
+	assert.EqStr("The　Girls　Live　▽道重さゆみ卒業ライブに密着▽LoVendoЯスタジオライブ", item.Title, "Title")
+	assert.EqStr("http://tv.so-net.ne.jp/schedule/101072201412050100.action?from=rss", item.Link, "Link")
+	assert.EqStr("12/5 1:00～1:30 [テレビ東京(Ch.7)]", item.Description, "Description")
+	assert.EqStr("テレビ東京", item.Station, "Station")
+	assert.EqInt(2, len(item.Subjects), "Subjects")
+	assert.EqStr("バラエティー", item.Subjects[0], "Subjects[0]")
+	assert.EqStr("音楽", item.Subjects[1], "Subjects[1]")
+	assert.Ok(item.Date.Equal(time.Date(2014, 12, 5, 1, 0, 0, 0, jst)), "Date")
+	assert.Ok(item.StartAt.Equal(time.Date(2014, 12, 5, 1, 0, 0, 0, jst)), "StartAt")
+	assert.Ok(item.EndAt.Equal(time.Date(2014, 12, 5, 1, 30, 0, 0, jst)), "EndAt")
+
+	item = items[1]
+	assert.EqStr("101056201412052300", item.Id, "Id")
+	assert.EqStr("フジテレビ", item.Station, "Station")
+	assert.EqStr("1056", item.Sid, "Sid")
+	assert.EqInt(63412, item.EventId, "EventId")
+}
+
+func TestParseFeed_RSS2(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	items, err := ParseFeed(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"><channel><title>番組表</title>
+<item>
+  <title>深夜アニメ</title>
+  <link>http://tv.so-net.ne.jp/schedule/101040201412110214.action?from=rss</link>
+  <description>12/11 23:50～0:20 [日本テレビ(Ch.4)]</description>
+  <pubDate>Thu, 11 Dec 2014 23:50:00 +0900</pubDate>
+  <category>アニメ</category>
+</item>
+</channel></rss>`))
+	assert.Nil(err, "ParseFeed should not return an error.")
+	assert.EqInt(1, len(items), "ParseFeed should return all items.")
+	item := items[0]
+	assert.EqStr("101040201412110214", item.Id, "Id")
+	assert.EqStr("日本テレビ", item.Station, "Station")
+	assert.EqStr("アニメ", item.Subjects[0], "Subjects[0]")
+	assert.Ok(item.Date.Equal(time.Date(2014, 12, 11, 23, 50, 0, 0, jst)), "Date")
+	assert.Ok(item.StartAt.Equal(time.Date(2014, 12, 11, 23, 50, 0, 0, jst)), "StartAt")
+	assert.Ok(item.EndAt.Equal(time.Date(2014, 12, 12, 0, 20, 0, 0, jst)), "EndAt should roll over the midnight.")
+}
+
+func TestParseFeed_NewYear(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	items, err := ParseFeed(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"><channel><title>番組表</title>
+<item>
+  <title>年越し特番</title>
+  <link>http://tv.so-net.ne.jp/schedule/101040201412312345.action?from=rss</link>
+  <description>12/31 23:45～0:15 [日本テレビ(Ch.4)]</description>
+  <pubDate>Sun, 28 Dec 2014 12:00:00 +0900</pubDate>
+</item>
+<item>
+  <title>新春特番</title>
+  <link>http://tv.so-net.ne.jp/schedule/101040201501021900.action?from=rss</link>
+  <description>1/2 19:00～21:00 [日本テレビ(Ch.4)]</description>
+  <pubDate>Sun, 28 Dec 2014 12:00:00 +0900</pubDate>
+</item>
+</channel></rss>`))
+	assert.Nil(err, "ParseFeed should not return an error.")
+	assert.Ok(items[0].StartAt.Equal(time.Date(2014, 12, 31, 23, 45, 0, 0, jst)), "StartAt in the year of the date")
+	assert.Ok(items[0].EndAt.Equal(time.Date(2015, 1, 1, 0, 15, 0, 0, jst)), "EndAt should roll over the new year.")
+	assert.Ok(items[1].StartAt.Equal(time.Date(2015, 1, 2, 19, 0, 0, 0, jst)), "StartAt should be in the next year.")
+	assert.Ok(items[1].EndAt.Equal(time.Date(2015, 1, 2, 21, 0, 0, 0, jst)), "EndAt should be in the next year.")
+}
+
+func TestParseFeed_Atom(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	items, err := ParseFeed(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>番組表</title>
+<entry>
+  <id>urn:uuid:1</id>
+  <title>ニュース</title>
+  <link rel="alternate" href="http://tv.so-net.ne.jp/schedule/400639201412120930.action"/>
+  <summary>12/12 9:30～10:00 [BS1]</summary>
+  <updated>2014-12-12T09:30:00+09:00</updated>
+  <category term="ニュース"/>
+</entry>
+</feed>`))
+	assert.Nil(err, "ParseFeed should not return an error.")
+	assert.EqInt(1, len(items), "ParseFeed should return all items.")
+	item := items[0]
+	assert.EqStr("400639201412120930", item.Id, "Id")
+	assert.EqStr("BS1", item.Station, "Station")
+	assert.EqStr("ニュース", item.Subjects[0], "Subjects[0]")
+	assert.Ok(item.StartAt.Equal(time.Date(2014, 12, 12, 9, 30, 0, 0, jst)), "StartAt")
+
+	_, err = ParseFeed(strings.NewReader(`<html></html>`))
+	assert.NotNil(err, "ParseFeed should return an error for unknown formats.")
+}
+
+func TestCrawlConfig_Filter(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	server, _, _ := newTestCrawlServer(map[string]string{
+		"1": "DFS00400", "2": "DFS00400", "3": "DFS00400",
+	})
+	defer server.Close()
+
+	crawler := NewCrawler(http.DefaultClient)
+	crawler.Source = NewSoNetSource(server.URL)
+	crawler.Interval = 0
+	crawler.Filter = func(item *FeedItem) bool {
+		return item.Id != "2"
+	}
+	list, errs := crawler.CrawlConfig(&CrawlerConfig{Keyword: "番組", Category: "test"})
+	assert.Nil(errs, "CrawlConfig should not return errors.")
+	assert.EqInt(2, len(list), "CrawlConfig should not fetch the filtered programs.")
+	assert.EqStr("1", list[0].Id, "Id")
+	assert.EqStr("3", list[1].Id, "Id")
+}
@@ -0,0 +1,269 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util/jptext"
+)
+
+// GenreCode is an ARIB STD-B10 genre, content_nibble_level_1 << 4 | content_nibble_level_2.
+type GenreCode int
+
+type GenreName struct {
+	Ja string `json:"ja_JP"`
+	En string `json:"en"`
+}
+
+// Genre is an entry of the ARIB genre table.
+type Genre struct {
+	Code   GenreCode `json:"code"`
+	Large  GenreName `json:"large"`
+	Middle GenreName `json:"middle"`
+}
+
+func NewGenreCode(level1 int, level2 int) GenreCode {
+	return GenreCode((level1&0xf)<<4 | level2&0xf)
+}
+
+func (c GenreCode) Level1() int {
+	return int(c>>4) & 0xf
+}
+
+func (c GenreCode) Level2() int {
+	return int(c) & 0xf
+}
+
+func (c GenreCode) String() string {
+	return fmt.Sprintf("0x%02X", int(c))
+}
+
+// Genre returns the entry in the table, or nil if the code is not defined.
+func (c GenreCode) Genre() *Genre {
+	if c < 0 || c > 0xff {
+		return nil
+	}
+	large := genreTable[c.Level1()]
+	middle := large.middles[c.Level2()]
+	if middle.Ja == "" {
+		return nil
+	}
+	return &Genre{
+		Code:   c,
+		Large:  large.name,
+		Middle: middle,
+	}
+}
+
+// Category returns the Category which has the Japanese names as epgdump does.
+func (g *Genre) Category() Category {
+	code := g.Code
+	return Category{
+		Large:  g.Large.Ja,
+		Middle: g.Middle.Ja,
+		Code:   &code,
+	}
+}
+
+// RecordCategory returns the name for TvRecord.Category, such as "news" and "anime".
+func (g *Genre) RecordCategory() string {
+	return g.Large.En
+}
+
+// XMLTVCategories returns the English category strings for XMLTV.
+func (g *Genre) XMLTVCategories() []string {
+	return []string{g.Large.En, g.Middle.En}
+}
+
+// LookupGenre returns the genre by the Japanese or English names. The names
+// are compared after normalized so that "ニュース/報道" matches "ニュース／報道".
+// An empty middle matches the genre "その他" (0xF) of the large genre.
+func LookupGenre(large string, middle string) (*Genre, bool) {
+	large, middle = jptext.Normalize(large), jptext.Normalize(middle)
+	for l, entry := range genreTable {
+		if !matchGenreName(entry.name, large) {
+			continue
+		}
+		if middle == "" {
+			return NewGenreCode(l, 0xf).Genre(), true
+		}
+		for m, name := range entry.middles {
+			if name.Ja != "" && matchGenreName(name, middle) {
+				return NewGenreCode(l, m).Genre(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func matchGenreName(name GenreName, s string) bool {
+	return s != "" && (jptext.Normalize(name.Ja) == s || name.En == s)
+}
+
+// Genre returns the genre of the category by Code or the names.
+func (c Category) Genre() *Genre {
+	if c.Code != nil {
+		return c.Code.Genre()
+	}
+	g, _ := LookupGenre(c.Large, c.Middle)
+	return g
+}
+
+// RecordCategory returns the TvRecord.Category for the first category of
+// the program which is in the genre table, or "etc".
+func (epg *Epg) RecordCategory() string {
+	for _, c := range epg.Categories {
+		if g := c.Genre(); g != nil {
+			return g.RecordCategory()
+		}
+	}
+	return "etc"
+}
+
+type genreEntry struct {
+	name    GenreName
+	middles [16]GenreName
+}
+
+var genreOther = GenreName{"その他", "Other"}
+
+// ARIB STD-B10 Part 2 Annex H
+var genreTable = [16]genreEntry{
+	{GenreName{"ニュース／報道", "news"}, [16]GenreName{
+		{"定時・総合", "Regular/General"},
+		{"天気", "Weather"},
+		{"特集・ドキュメント", "Special/Documentary"},
+		{"政治・国会", "Politics/Parliament"},
+		{"経済・市況", "Economics/Market"},
+		{"海外・国際", "Overseas/International"},
+		{"解説", "Commentary"},
+		{"討論・会談", "Discussion/Conference"},
+		{"報道特番", "Special Report"},
+		{"ローカル・地域", "Local"},
+		{"交通", "Traffic"},
+		15: genreOther,
+	}},
+	{GenreName{"スポーツ", "sports"}, [16]GenreName{
+		{"スポーツニュース", "Sports News"},
+		{"野球", "Baseball"},
+		{"サッカー", "Soccer"},
+		{"ゴルフ", "Golf"},
+		{"その他の球技", "Other Ball Games"},
+		{"相撲・格闘技", "Sumo/Martial Arts"},
+		{"オリンピック・国際大会", "Olympics/International Games"},
+		{"マラソン・陸上・水泳", "Marathon/Athletics/Swimming"},
+		{"モータースポーツ", "Motor Sports"},
+		{"マリン・ウィンタースポーツ", "Marine/Winter Sports"},
+		{"競馬・公営競技", "Horse Racing/Public Race"},
+		15: genreOther,
+	}},
+	{GenreName{"情報／ワイドショー", "information"}, [16]GenreName{
+		{"芸能・ワイドショー", "Entertainment/Variety Show"},
+		{"ファッション", "Fashion"},
+		{"暮らし・住まい", "Life/Home"},
+		{"健康・医療", "Health/Medical"},
+		{"ショッピング・通販", "Shopping"},
+		{"グルメ・料理", "Gourmet/Cooking"},
+		{"イベント", "Event"},
+		{"番組紹介・お知らせ", "Program Guide/Information"},
+		15: genreOther,
+	}},
+	{GenreName{"ドラマ", "drama"}, [16]GenreName{
+		{"国内ドラマ", "Japanese Drama"},
+		{"海外ドラマ", "Overseas Drama"},
+		{"時代劇", "Period Drama"},
+		15: genreOther,
+	}},
+	{GenreName{"音楽", "music"}, [16]GenreName{
+		{"国内ロック・ポップス", "Japanese Rock/Pop"},
+		{"海外ロック・ポップス", "Overseas Rock/Pop"},
+		{"クラシック・オペラ", "Classical/Opera"},
+		{"ジャズ・フュージョン", "Jazz/Fusion"},
+		{"歌謡曲・演歌", "Kayokyoku/Enka"},
+		{"ライブ・コンサート", "Live/Concert"},
+		{"ランキング・リクエスト", "Ranking/Request"},
+		{"カラオケ・のど自慢", "Karaoke/Amateur Singing"},
+		{"民謡・邦楽", "Folk/Traditional Japanese Music"},
+		{"童謡・キッズ", "Children's Songs"},
+		{"民族音楽・ワールドミュージック", "Ethnic/World Music"},
+		15: genreOther,
+	}},
+	{GenreName{"バラエティ", "variety"}, [16]GenreName{
+		{"クイズ", "Quiz"},
+		{"ゲーム", "Game"},
+		{"トークバラエティ", "Talk Variety"},
+		{"お笑い・コメディ", "Comedy"},
+		{"音楽バラエティ", "Music Variety"},
+		{"旅バラエティ", "Travel Variety"},
+		{"料理バラエティ", "Cooking Variety"},
+		15: genreOther,
+	}},
+	{GenreName{"映画", "cinema"}, [16]GenreName{
+		{"洋画", "Foreign Film"},
+		{"邦画", "Japanese Film"},
+		{"アニメ", "Animation"},
+		15: genreOther,
+	}},
+	{GenreName{"アニメ／特撮", "anime"}, [16]GenreName{
+		{"国内アニメ", "Japanese Anime"},
+		{"海外アニメ", "Overseas Anime"},
+		{"特撮", "Special Effects"},
+		15: genreOther,
+	}},
+	{GenreName{"ドキュメンタリー／教養", "documentary"}, [16]GenreName{
+		{"社会・時事", "Society/Current Affairs"},
+		{"歴史・紀行", "History/Travel"},
+		{"自然・動物・環境", "Nature/Animals/Environment"},
+		{"宇宙・科学・医学", "Space/Science/Medicine"},
+		{"カルチャー・伝統文化", "Culture/Tradition"},
+		{"文学・文芸", "Literature"},
+		{"スポーツ", "Sports"},
+		{"ドキュメンタリー全般", "Documentary"},
+		{"インタビュー・討論", "Interview/Discussion"},
+		15: genreOther,
+	}},
+	{GenreName{"劇場／公演", "stage"}, [16]GenreName{
+		{"現代劇・新劇", "Modern Drama"},
+		{"ミュージカル", "Musical"},
+		{"ダンス・バレエ", "Dance/Ballet"},
+		{"落語・演芸", "Rakugo/Entertainment"},
+		{"歌舞伎・古典", "Kabuki/Classical"},
+		15: genreOther,
+	}},
+	{GenreName{"趣味／教育", "hobby"}, [16]GenreName{
+		{"旅・釣り・アウトドア", "Travel/Fishing/Outdoor"},
+		{"園芸・ペット・手芸", "Gardening/Pets/Handicrafts"},
+		{"音楽・美術・工芸", "Music/Art/Crafts"},
+		{"囲碁・将棋", "Go/Shogi"},
+		{"麻雀・パチンコ", "Mahjong/Pachinko"},
+		{"車・オートバイ", "Cars/Motorcycles"},
+		{"コンピュータ・ＴＶゲーム", "Computer/Video Games"},
+		{"会話・語学", "Conversation/Languages"},
+		{"幼児・小学生", "Preschool/Elementary School"},
+		{"中学生・高校生", "Junior/Senior High School"},
+		{"大学生・受験", "University/Entrance Exams"},
+		{"生涯教育・資格", "Lifelong Learning/Qualifications"},
+		{"教育問題", "Educational Issues"},
+		15: genreOther,
+	}},
+	{GenreName{"福祉", "welfare"}, [16]GenreName{
+		{"高齢者", "Elderly"},
+		{"障害者", "Disabled"},
+		{"社会福祉", "Social Welfare"},
+		{"ボランティア", "Volunteer"},
+		{"手話", "Sign Language"},
+		{"文字（字幕）", "Text (Subtitles)"},
+		{"音声解説", "Audio Description"},
+		15: genreOther,
+	}},
+	{GenreName{"予備", "reserved"}, [16]GenreName{}},
+	{GenreName{"予備", "reserved"}, [16]GenreName{}},
+	{GenreName{"拡張", "extension"}, [16]GenreName{
+		{"BS/地上デジタル放送用番組付属情報", "Attached Information for BS/Terrestrial"},
+		{"広帯域CS デジタル放送用拡張", "Extension for Broadband CS"},
+		{"衛星デジタル音声放送用拡張", "Extension for Digital Satellite Sound Broadcasting"},
+		{"サーバー型番組付属情報", "Attached Information for Server Type"},
+		{"IP 放送用番組付属情報", "Attached Information for IP Broadcasting"},
+	}},
+	{GenreName{"その他", "etc"}, [16]GenreName{
+		15: genreOther,
+	}},
+}
@@ -0,0 +1,81 @@
+package tv
+
+import (
+	"bytes"
+	"github.com/speedland/wcg"
+	"strings"
+	"testing"
+)
+
+func TestGenreCode(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	code := NewGenreCode(0x7, 0x0)
+	assert.EqStr("0x70", code.String(), "String")
+	assert.EqInt(7, code.Level1(), "Level1")
+	g := code.Genre()
+	assert.EqStr("アニメ／特撮", g.Large.Ja, "Large.Ja")
+	assert.EqStr("国内アニメ", g.Middle.Ja, "Middle.Ja")
+	assert.EqStr("anime", g.RecordCategory(), "RecordCategory")
+	assert.EqInt(2, len(g.XMLTVCategories()), "XMLTVCategories")
+	assert.Ok(NewGenreCode(0x3, 0x5).Genre() == nil, "Undefined genre")
+	assert.Ok(NewGenreCode(0xc, 0x0).Genre() == nil, "Reserved genre")
+
+	g, ok := LookupGenre("ニュース/報道", "天気")
+	assert.Ok(ok, "LookupGenre should normalize the names.")
+	assert.EqStr("0x01", g.Code.String(), "Code")
+	g, ok = LookupGenre("sports", "Baseball")
+	assert.Ok(ok, "LookupGenre by English names")
+	assert.EqStr("0x11", g.Code.String(), "Code")
+	g, _ = LookupGenre("ドラマ", "")
+	assert.EqStr("0x3F", g.Code.String(), "Empty middle is その他")
+	_, ok = LookupGenre("unknown", "")
+	assert.Ok(!ok, "Unknown genre")
+}
+
+func TestGenreCode_Extension(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	names := []string{
+		"BS/地上デジタル放送用番組付属情報",
+		"広帯域CS デジタル放送用拡張",
+		"衛星デジタル音声放送用拡張",
+		"サーバー型番組付属情報",
+		"IP 放送用番組付属情報",
+	}
+	for i := 0; i < 16; i++ {
+		g := NewGenreCode(0xe, i).Genre()
+		if i >= len(names) {
+			assert.Ok(g == nil, "Reserved sub-code "+NewGenreCode(0xe, i).String())
+			continue
+		}
+		assert.NotNil(g, "Sub-code "+NewGenreCode(0xe, i).String())
+		assert.EqStr("拡張", g.Large.Ja, "Large.Ja")
+		assert.EqStr(names[i], g.Middle.Ja, "Middle.Ja")
+	}
+}
+
+func TestParseEpgJson_Genre(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	list, _ := ParseEpgJsonString(testJson)
+	c := list[0].Categories[1]
+	assert.NotNil(c.Code, "Code should be looked up by the names.")
+	assert.EqStr("0x01", c.Code.String(), "Code")
+	assert.EqStr("news", list[0].RecordCategory(), "RecordCategory")
+
+	list, errs := ParseEpgJsonString(`[{"programs": [{
+	  "event_id": 1, "channel": "GR5_1064", "title": "a", "start": 14010548400000, "end": 14010550800000,
+	  "category": [{"large": 7, "middle": 0}, {"large": {"ja_JP": "不明", "en": "unknown"}}]
+	}]}]`)
+	assert.Nil(errs, "Numeric genre codes should be parsed.")
+	assert.EqStr("アニメ／特撮", list[0].Categories[0].Large, "Large from the code")
+	assert.EqStr("国内アニメ", list[0].Categories[0].Middle, "Middle from the code")
+	assert.Ok(list[0].Categories[1].Code == nil, "Unknown genre")
+	assert.EqStr("anime", list[0].RecordCategory(), "RecordCategory")
+	assert.EqStr("etc", (&Epg{}).RecordCategory(), "RecordCategory without categories")
+
+	var buff bytes.Buffer
+	WriteXMLTV(&buff, nil, list)
+	assert.Ok(strings.Contains(buff.String(), `<category lang="en">Japanese Anime</category>`), "XMLTV should have English categories.")
+	parsed, _, _ := ParseXMLTV(&buff)
+	assert.EqInt(2, len(parsed[0].Categories), "English categories should not be parsed.")
+	assert.EqStr("0x70", parsed[0].Categories[0].Code.String(), "Code should be looked up in XMLTV.")
+}
@@ -0,0 +1,124 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"time"
+)
+
+// OutputRecord is implemented by a Record which can tell the current size
+// of its output so that the recorder can monitor the growth of the output.
+type OutputRecord interface {
+	OutputSize() (int64, error)
+}
+
+// MetricsPoster is an interface to publish metrics, satisfied by *models.CounterClient.
+type MetricsPoster interface {
+	PostMany(name string, table map[string]interface{}) error
+}
+
+// HealthMonitor detects stalled recordings by the growth rate of the output
+// while the recording process is running.
+type HealthMonitor struct {
+	MinBitrate     int64         // bytes per second, a recording below this rate is stalled.
+	StallTimeout   time.Duration // the rate should stay below MinBitrate for this duration to be stalled.
+	RestartOnStall bool          // stop the stalled process so that it is restarted by the RestartPolicy.
+	Counter        MetricsPoster // publish throughput metrics if set.
+	MetricsName    string
+	logger         wcg.Logger
+}
+
+func NewHealthMonitor(minBitrate int64, stallTimeout time.Duration) *HealthMonitor {
+	return &HealthMonitor{
+		MinBitrate:   minBitrate,
+		StallTimeout: stallTimeout,
+		MetricsName:  "tv.recorder.throughput",
+		logger:       util.GetLogger(),
+	}
+}
+
+// log returns the logger, which is unset if m is built without NewHealthMonitor.
+func (m *HealthMonitor) log() wcg.Logger {
+	if m.logger == nil {
+		return util.GetLogger()
+	}
+	return m.logger
+}
+
+// health is a monitoring state of a RecordCtrl.
+type health struct {
+	lastSize     int64
+	lastAt       time.Time
+	stalledSince time.Time
+	stalled      bool
+	stalls       int
+	bitrate      int64
+}
+
+// check updates the health of the ctrl and returns true if it gets stalled.
+func (m *HealthMonitor) check(ctrl *RecordCtrl, now time.Time) bool {
+	rec, ok := ctrl.record.(OutputRecord)
+	if !ok {
+		return false
+	}
+	size, err := rec.OutputSize()
+	if err != nil {
+		m.log().Warn("%v: Could not get the output size - %v", rec, err)
+		return false
+	}
+	h := &ctrl.health
+	if h.lastAt.IsZero() || size < h.lastSize {
+		// first check or a new segment, which may be stalled again.
+		h.lastSize, h.lastAt = size, now
+		h.stalledSince = time.Time{}
+		h.stalled = false
+		return false
+	}
+	elapsed := now.Sub(h.lastAt)
+	if elapsed <= 0 {
+		return false
+	}
+	h.bitrate = int64(float64(size-h.lastSize) / elapsed.Seconds())
+	h.lastSize, h.lastAt = size, now
+	m.post(ctrl, size)
+
+	if h.bitrate >= m.MinBitrate {
+		if h.stalled {
+			m.log().Info("%v: Recording recovered (%d bytes/sec).", rec, h.bitrate)
+		}
+		h.stalledSince = time.Time{}
+		h.stalled = false
+		return false
+	}
+	if h.stalledSince.IsZero() {
+		h.stalledSince = now.Add(-elapsed)
+	}
+	if h.stalled || now.Sub(h.stalledSince) < m.StallTimeout {
+		return false
+	}
+	h.stalled = true
+	h.stalls += 1
+	m.log().Warn("%v: Recording stalled (%d bytes/sec for %v).", rec, h.bitrate, now.Sub(h.stalledSince))
+	return true
+}
+
+func (m *HealthMonitor) post(ctrl *RecordCtrl, size int64) {
+	if m.Counter == nil {
+		return
+	}
+	h := ctrl.health
+	table := map[string]interface{}{
+		"key":     ctrl.record.Key(),
+		"bytes":   size,
+		"bitrate": h.bitrate,
+		"stalled": h.stalled,
+	}
+	go func() {
+		if err := m.Counter.PostMany(m.MetricsName, table); err != nil {
+			m.log().Warn("%v: Could not post metrics - %v", ctrl.record, err)
+		}
+	}()
+}
+
+var ErrStalled = fmt.Errorf("Output of the recording is stalled")
@@ -0,0 +1,95 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/wcg"
+	"testing"
+	"time"
+)
+
+type SizedDummyRecord struct {
+	*DummyRecord
+	size int64
+}
+
+func (dr *SizedDummyRecord) OutputSize() (int64, error) {
+	return dr.size, nil
+}
+
+type UnsizedDummyRecord struct {
+	*DummyRecord
+}
+
+func (dr *UnsizedDummyRecord) OutputSize() (int64, error) {
+	return 0, fmt.Errorf("no output")
+}
+
+type dummyPoster struct {
+	posted chan map[string]interface{}
+}
+
+func (p *dummyPoster) PostMany(name string, table map[string]interface{}) error {
+	p.posted <- table
+	return nil
+}
+
+func TestHealthMonitor(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	now := time.Now()
+	r := &SizedDummyRecord{DummyRecord: NewDummyRecord("r1")}
+	r.startAt = now
+	r.endAt = now.Add(30 * time.Minute)
+	poster := &dummyPoster{make(chan map[string]interface{}, 10)}
+	monitor := NewHealthMonitor(100, 20*time.Second)
+	monitor.RestartOnStall = true
+	monitor.Counter = poster
+
+	ctrl := NewRecordCtrl(r)
+	ctrl.monitor = monitor
+	ctrl.control(now)
+	assert.EqInt(int(RSRecording), int(ctrl.state), "Recording should be started.")
+
+	ctrl.control(now.Add(10 * time.Second)) // first check
+	r.size = 2000
+	ctrl.control(now.Add(20 * time.Second))
+	table := <-poster.posted
+	assert.Ok(table["bitrate"].(int64) == 200, "bitrate should be posted.")
+	assert.Ok(!ctrl.health.stalled, "Recording should not be stalled.")
+
+	r.size = 2500
+	ctrl.control(now.Add(30 * time.Second))
+	assert.Ok(!ctrl.health.stalled, "Recording should not be stalled before StallTimeout.")
+	r.size = 2600
+	ctrl.control(now.Add(40 * time.Second))
+	assert.Ok(ctrl.health.stalled, "Recording should be stalled after StallTimeout.")
+	assert.EqInt(1, ctrl.health.stalls, "Stalls should be counted.")
+	assert.EqInt(int(FRSignalLost), int(ctrl.reason), "Stalled recording should be classified as signal lost.")
+}
+
+func TestHealthMonitor_StallAgain(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	now := time.Now()
+	r := &SizedDummyRecord{DummyRecord: NewDummyRecord("r1")}
+	monitor := NewHealthMonitor(100, 20*time.Second)
+	ctrl := NewRecordCtrl(r)
+
+	assert.Ok(!monitor.check(ctrl, now), "First check should not be stalled.")
+	r.size = 100
+	assert.Ok(!monitor.check(ctrl, now.Add(10*time.Second)), "Recording should not be stalled before StallTimeout.")
+	assert.Ok(monitor.check(ctrl, now.Add(20*time.Second)), "Recording should be stalled after StallTimeout.")
+
+	// restarted with a new segment.
+	r.size = 0
+	assert.Ok(!monitor.check(ctrl, now.Add(30*time.Second)), "New segment should not be stalled.")
+	assert.Ok(!ctrl.health.stalled, "Stall should be cleared by the new segment.")
+	assert.Ok(!monitor.check(ctrl, now.Add(40*time.Second)), "New segment should not be stalled before StallTimeout.")
+	assert.Ok(monitor.check(ctrl, now.Add(50*time.Second)), "New segment should be stalled again.")
+	assert.EqInt(2, ctrl.health.stalls, "Both stalls should be counted.")
+}
+
+func TestHealthMonitor_Literal(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	monitor := &HealthMonitor{MinBitrate: 100, StallTimeout: 20 * time.Second}
+	ctrl := NewRecordCtrl(&UnsizedDummyRecord{NewDummyRecord("r1")})
+	assert.Ok(!monitor.check(ctrl, time.Now()), "check should work without the logger.")
+}
@@ -2,43 +2,54 @@ package tv
 
 import (
 	"bufio"
-	"code.google.com/p/go-html-transform/css/selector"
-	"code.google.com/p/go.net/html"
 	"code.google.com/p/go.text/encoding/japanese"
 	"code.google.com/p/go.text/transform"
 	"fmt"
 	"github.com/speedland/lib/util"
+	"github.com/speedland/lib/util/jptext"
 	"github.com/speedland/wcg"
 	v "github.com/speedland/wcg/validation"
 	"io"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type IEpg struct {
-	Id           string          `json:"id"`
-	StationId    string          `json:"station_id"`
-	StationName  string          `json:"station_name"`
-	ProgramTitle string          `json:"program_title"`
-	ProgramId    int             `json:"program_id"`
-	Body         util.ByteString `json:"detail"`
-	StartAt      time.Time       `json:"start_at"`
-	EndAt        time.Time       `json:"end_at"`
-	Category     string          `json:"category"`
-	Cid          string          `json:"cid"`
-	Sid          string          `json:"sid"`
-	Optout       bool            `json:"optout"`
-	CreatedAt    time.Time       `json:"created_at"`
-	UpdatedAt    time.Time       `json:"updated_at"`
+	Id              string            `json:"id"`
+	ContentType     string            `json:"content_type"`
+	Version         int               `json:"version"`
+	StationId       string            `json:"station_id"`
+	StationName     string            `json:"station_name"`
+	ProgramTitle    string            `json:"program_title"`
+	ProgramSubtitle string            `json:"program_subtitle"`
+	Performer       string            `json:"performer"`
+	ProgramId       int               `json:"program_id"`
+	Genres          []GenreCode       `json:"genres"`
+	Headers         map[string]string `json:"headers"` // other headers such as Copycontrol-1
+	Body            util.ByteString   `json:"detail"`
+	StartAt         time.Time         `json:"start_at"`
+	EndAt           time.Time         `json:"end_at"`
+	Category        string            `json:"category"`
+	Cid             string            `json:"cid"`
+	Sid             string            `json:"sid"`
+	Optout          bool              `json:"optout"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	Warnings        []string          `json:"-"` // malformed lines found in parsing
+}
+
+// Flags returns the ARIB flags in the title.
+func (iepg *IEpg) Flags() jptext.Flags {
+	_, flags := jptext.ExtractFlags(iepg.ProgramTitle)
+	return flags
 }
 
 func (iepg *IEpg) ToTvRecord() *TvRecord {
 	return &TvRecord{
 		Id:        wcg.Must(wcg.UUID()).(string),
-		Title:     strings.Replace(iepg.ProgramTitle, "/", "／", -1),
+		Title:     recordTitle(iepg.ProgramTitle),
 		Category:  iepg.Category,
 		StartAt:   iepg.StartAt,
 		EndAt:     iepg.EndAt,
@@ -46,22 +57,56 @@ func (iepg *IEpg) ToTvRecord() *TvRecord {
 		Sid:       iepg.Sid,
 		Uid:       "", // for future use.
 		IEpgId:    iepg.Id,
+		Meta:      iepg.meta(),
 		CreatedAt: iepg.CreatedAt,
 		UpdatedAt: iepg.UpdatedAt,
 	}
 }
 
+func (iepg *IEpg) meta() *ProgramMeta {
+	var ext map[string]string
+	if iepg.Performer != "" {
+		ext = map[string]string{"出演者": iepg.Performer}
+	}
+	meta := ExtractProgramMeta(iepg.ProgramTitle, string(iepg.Body), ext)
+	if iepg.ProgramSubtitle != "" {
+		meta.Subtitle = iepg.ProgramSubtitle
+	}
+	return meta
+}
+
 type Crawler struct {
-	client *http.Client
+	Source      EpgSource
+	Channels    []*TvChannel  // to map StationId to Cid and Sid in CrawlConfig
+	Concurrency int           // max number of iEPG requests at a time
+	Interval    time.Duration // min interval between requests to a host
+	client      *http.Client
+	limiter     *hostLimiter
+
+	// Filter skips the programs in the feed before fetching their iEPGs,
+	// which is used only if the source is a FeedEpgSource.
+	Filter func(item *FeedItem) bool
 }
 
+// NewCrawler returns a Crawler with the source of DefaultEpgSource, or the
+// SoNetSource if DefaultEpgSource is not registered.
 func NewCrawler(client *http.Client) *Crawler {
+	source, ok := GetEpgSource(DefaultEpgSource)
+	if !ok {
+		util.GetLogger().Warn("Unknown EPG source %q, so-net is used instead.", DefaultEpgSource)
+		source = NewSoNetSource("")
+	}
 	return &Crawler{
-		client,
+		Source:      source,
+		Concurrency: DefaultCrawlConcurrency,
+		Interval:    DefaultCrawlInterval,
+		client:      client,
+		limiter:     newHostLimiter(),
 	}
 }
 
 type CrawlerConfig struct {
+	Source    string    `json:"source"` // name of the EpgSource, empty for the crawler's source
 	Keyword   string    `json:"keyword"`
 	Category  string    `json:"category"`
 	Scope     int       `json:"scope"`
@@ -80,109 +125,251 @@ const FEED_SCOPE_TERRESTRIAL = 1
 const FEED_SCOPE_BS = 2
 const FEED_SCOPE_CS = 5
 const FEED_SCOPE_CS_PREMIUM = 4
-const feed_url_template = "http://tv.so-net.ne.jp/rss/schedulesBySearch.action?stationPlatformId=%d&condition.keyword=%s"
-const iepg_url_template = "http://tv.so-net.ne.jp/iepg.tvpid?id=%s"
 
+// GetIEpgList searches the programs by the keyword in c.Source and returns their ids.
 func (c *Crawler) GetIEpgList(keyword string, scope int) ([]string, error) {
-	urlstr := fmt.Sprintf(feed_url_template, scope, url.QueryEscape(keyword))
-	resp, err := c.client.Get(urlstr)
-	if err != nil {
-		return nil, fmt.Errorf("HTTP Error: %v (url = %q)", err, urlstr)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Non-200 code (%d) was returned from %q", resp.StatusCode, urlstr)
-	}
-	list, err := ParseRss(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Could not parse RSS from %q: %v", urlstr, err)
-	}
-	return list, nil
+	return c.Source.Search(HttpGetterFunc(c.get), keyword, scope)
 }
 
+// GetIEpg fetches the iEPG of the program from c.Source.
 func (c *Crawler) GetIEpg(id string) (*IEpg, error) {
-	urlstr := fmt.Sprintf(iepg_url_template, id)
-	resp, err := c.client.Get(urlstr)
+	iepg, err := c.Source.Fetch(HttpGetterFunc(c.get), id)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP Error: %v (url = %q)", err, urlstr)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Non-200 code (%d) was returned from %q", resp.StatusCode, urlstr)
-	}
-	iepg, err := ParseIEpg(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Could not parse RSS from %q: %v", urlstr, err)
+		return nil, err
 	}
 	iepg.Id = id
 	return iepg, nil
 }
 
-const datetime_format = "%s-%s-%s %s:00 +0900"
-const datetime_layout = "2006-01-02 15:04:05 -0700"
-
+// ParseIEpg parses the first program in the iEPG file.
 func ParseIEpg(r io.Reader) (*IEpg, error) {
-	var err error
-	iepg := &IEpg{}
-	iepg.Body = make([]byte, 0)
+	list, err := ParseIEpgs(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("No program is found in iEPG.")
+	}
+	return list[0], nil
+}
+
+// ParseIEpgs parses all programs in the iEPG 1 (.tvpi) or iEPG 2 (.tvpid)
+// file. A new program starts at the "Content-type" header. Malformed lines
+// are reported on IEpg.Warnings.
+func ParseIEpgs(r io.Reader) ([]*IEpg, error) {
 	rio := transform.NewReader(r, japanese.ShiftJIS.NewDecoder())
 	scanner := bufio.NewScanner(rio)
-	kv := make(map[string]string)
+	list := make([]*IEpg, 0)
+	var block *iepgBlock
+	lineno := 0
+	flush := func() error {
+		if block == nil || len(block.headers) == 0 {
+			return nil
+		}
+		iepg, err := block.build()
+		if err != nil {
+			return fmt.Errorf("Could not parse the program at line %d: %v", block.lineno, err)
+		}
+		list = append(list, iepg)
+		return nil
+	}
 	for scanner.Scan() {
 		line := scanner.Text()
-		if line == "" {
-			for scanner.Scan() {
-				line = scanner.Text()
-				iepg.Body = append(iepg.Body, []byte(line)...)
+		lineno += 1
+		key, value, ok := splitIEpgHeader(line)
+		if block == nil || (ok && key == "content-type" && (block.inBody || block.has(key))) {
+			if err := flush(); err != nil {
+				return nil, err
 			}
-			break
+			block = newIEpgBlock(lineno)
 		}
-		tmp := strings.Split(line, ": ")
-		if len(tmp) != 2 {
-			fmt.Printf("%q", line)
+		if block.inBody {
+			block.body = append(block.body, line)
 			continue
 		}
-		kv[tmp[0]] = tmp[1]
+		switch {
+		case line == "":
+			// the body follows the headers after an empty line.
+			block.inBody = len(block.headers) > 0
+		case ok:
+			block.set(key, value)
+		default:
+			block.warnings = append(block.warnings, fmt.Sprintf("line %d: malformed header %q", lineno, line))
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("IEPG scan error: %v", err)
 	}
-	iepg.StationId = kv["station"]
-	iepg.StationName = kv["station-name"]
-	iepg.ProgramTitle = kv["program-title"]
-	if kv["program-id"] != "" {
-		if iepg.ProgramId, err = strconv.Atoi(kv["program-id"]); err != nil {
-			return nil, fmt.Errorf("Could not parse `program-id` - %q in %v: %v ", kv["program-id"], kv, err)
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+type iepgBlock struct {
+	lineno   int
+	headers  map[string]string
+	keys     []string
+	body     []string
+	inBody   bool
+	warnings []string
+}
+
+func newIEpgBlock(lineno int) *iepgBlock {
+	return &iepgBlock{
+		lineno:   lineno,
+		headers:  make(map[string]string),
+		keys:     make([]string, 0),
+		body:     make([]string, 0),
+		warnings: make([]string, 0),
+	}
+}
+
+func splitIEpgHeader(line string) (string, string, bool) {
+	kv := strings.SplitN(line, ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.Contains(kv[0], " ") {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1]), true
+}
+
+func (b *iepgBlock) has(key string) bool {
+	_, ok := b.headers[key]
+	return ok
+}
+
+func (b *iepgBlock) set(key string, value string) {
+	if b.has(key) {
+		b.warnings = append(b.warnings, fmt.Sprintf("duplicated header %q", key))
+	} else {
+		b.keys = append(b.keys, key)
+	}
+	b.headers[key] = value
+}
+
+// Headers which are stored in the IEpg fields.
+var iepgKnownHeaders = map[string]bool{
+	"content-type": true, "version": true, "station": true, "station-name": true,
+	"year": true, "month": true, "date": true, "start": true, "end": true,
+	"program-title": true, "program-subtitle": true, "performer": true, "program-id": true,
+}
+
+func (b *iepgBlock) build() (*IEpg, error) {
+	var err error
+	kv := b.headers
+	iepg := &IEpg{
+		ContentType:     kv["content-type"],
+		StationId:       kv["station"],
+		StationName:     kv["station-name"],
+		ProgramTitle:    kv["program-title"],
+		ProgramSubtitle: kv["program-subtitle"],
+		Performer:       kv["performer"],
+		Body:            []byte(strings.TrimRight(strings.Join(b.body, "\n"), "\n")),
+		Genres:          make([]GenreCode, 0),
+		Headers:         make(map[string]string),
+		Warnings:        b.warnings,
+	}
+	if iepg.StationName == "" {
+		// iEPG 1 has only the station name.
+		iepg.StationName = iepg.StationId
+	}
+	if v := kv["version"]; v != "" {
+		if iepg.Version, err = strconv.Atoi(v); err != nil {
+			iepg.Warnings = append(iepg.Warnings, fmt.Sprintf("invalid version %q", v))
 		}
 	}
-	start_time := fmt.Sprintf(datetime_format, kv["year"], kv["month"], kv["date"], kv["start"])
-	if iepg.StartAt, err = time.Parse(datetime_layout, start_time); err != nil {
-		return nil, fmt.Errorf("Could not parse start time - %q in %v: %v", start_time, kv, err)
+	if v := kv["program-id"]; v != "" {
+		if iepg.ProgramId, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("Could not parse `program-id` - %q: %v", v, err)
+		}
 	}
-	end_time := fmt.Sprintf(datetime_format, kv["year"], kv["month"], kv["date"], kv["end"])
-	if iepg.EndAt, err = time.Parse(datetime_layout, end_time); err != nil {
-		return nil, fmt.Errorf("Could not parse end time - %q in %v: %v", end_time, kv, err)
+	if iepg.StartAt, iepg.EndAt, err = parseIEpgTime(kv); err != nil {
+		return nil, err
+	}
+	for _, key := range b.keys {
+		if strings.HasPrefix(key, "genre") {
+			suffix := strings.TrimPrefix(key, "genre")
+			if code, ok := b.genre(kv[key], kv["subgenre"+suffix]); ok {
+				iepg.Genres = append(iepg.Genres, code)
+			}
+		} else if !strings.HasPrefix(key, "subgenre") && !iepgKnownHeaders[key] {
+			iepg.Headers[key] = kv[key]
+		}
 	}
 	return iepg, nil
 }
 
+// genre returns the ARIB genre code. The subgenre is "その他" if it is missing.
+func (b *iepgBlock) genre(genre string, subgenre string) (GenreCode, bool) {
+	level1, err := strconv.Atoi(genre)
+	if err != nil || level1 < 0 || level1 > 0xf {
+		b.warnings = append(b.warnings, fmt.Sprintf("invalid genre %q", genre))
+		return 0, false
+	}
+	level2 := 0xf
+	if subgenre != "" {
+		if level2, err = strconv.Atoi(subgenre); err != nil || level2 < 0 || level2 > 0xf {
+			b.warnings = append(b.warnings, fmt.Sprintf("invalid subgenre %q", subgenre))
+			level2 = 0xf
+		}
+	}
+	return NewGenreCode(level1, level2), true
+}
+
+// parseIEpgTime returns the start and end time in JST. The end time is on
+// the next day if it is not after the start time, and times after 24:00
+// are also on the next day.
+func parseIEpgTime(kv map[string]string) (time.Time, time.Time, error) {
+	var ymd [3]int
+	for i, key := range []string{"year", "month", "date"} {
+		v, err := strconv.Atoi(kv[key])
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Could not parse `%s` - %q", key, kv[key])
+		}
+		ymd[i] = v
+	}
+	date := time.Date(ymd[0], time.Month(ymd[1]), ymd[2], 0, 0, 0, 0, jst)
+	start, err := parseIEpgClock(kv["start"])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Could not parse start time - %q", kv["start"])
+	}
+	end, err := parseIEpgClock(kv["end"])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Could not parse end time - %q", kv["end"])
+	}
+	startAt, endAt := date.Add(start), date.Add(end)
+	if !endAt.After(startAt) {
+		endAt = endAt.AddDate(0, 0, 1)
+	}
+	return startAt, endAt, nil
+}
+
+func parseIEpgClock(s string) (time.Duration, error) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("invalid time")
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h >= 48 {
+		return 0, fmt.Errorf("invalid hour")
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m >= 60 {
+		return 0, fmt.Errorf("invalid minute")
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
 // Parse the RSS feed and returns iEPG Ids.
 func ParseRss(r io.Reader) ([]string, error) {
-	root, err := html.Parse(r)
+	items, err := ParseFeed(r)
 	if err != nil {
-		return nil, fmt.Errorf("Could not parse RSS feed: %v", err)
+		return nil, err
 	}
-	s, _ := selector.Selector("item")
-	nodes := s.Find(root)
 	list := []string{}
-	for _, n := range nodes {
-		for i := range n.Attr {
-			if n.Attr[i].Key == "rdf:about" {
-				id := extractIdFromUrl(n.Attr[i].Val)
-				if id != "" {
-					list = append(list, id)
-				}
-			}
+	for _, item := range items {
+		if item.Id != "" {
+			list = append(list, item.Id)
 		}
 	}
 	return list, nil
@@ -1,10 +1,16 @@
 package tv
 
 import (
+	"bytes"
+	"code.google.com/p/go.text/encoding/japanese"
+	"code.google.com/p/go.text/transform"
 	"github.com/speedland/wcg"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestGetIEpgList(t *testing.T) {
@@ -16,12 +22,23 @@ func TestGetIEpgList(t *testing.T) {
 }
 
 func TestGetIEpg(t *testing.T) {
-	t.Skipf("TestGetIEpg needs http server mock since the real side would remoe iEPG link after the program is broadcasted.")
-	// assert := wcg.NewAssert(t)
-	// client := NewCrawler(http.DefaultClient)
-	// list, err := client.GetIEpg("200171201412080100")
-	// assert.Nil(err, "GetIEpg should not return an error.")
-	// assert.NotNil(list, "GetIEpg should return list of ids")
+	assert := wcg.NewAssert(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/iepg.tvpid" || req.URL.Query().Get("id") != "200171201412080100" {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeFile(w, req, "./iepg-sample.iepg")
+	}))
+	defer server.Close()
+	client := NewCrawler(http.DefaultClient)
+	client.Source = NewSoNetSource(server.URL)
+	iepg, err := client.GetIEpg("200171201412080100")
+	assert.Nil(err, "GetIEpg should not return an error.")
+	assert.EqStr("200171201412080100", iepg.Id, "Id")
+	assert.EqStr("DFS00430", iepg.StationId, "StationId")
+	_, err = client.GetIEpg("unknown")
+	assert.NotNil(err, "GetIEpg should return an error for non-200 response.")
 }
 
 func TestParseRss(t *testing.T) {
@@ -64,4 +81,76 @@ func TestParseIEpg(t *testing.T) {
 	zone, _ = iepg.EndAt.Zone()
 	assert.EqStr("JST", zone, "EndAt.Zone")
 
+	assert.EqInt(2, iepg.Version, "Version")
+	assert.EqInt(2, len(iepg.Genres), "Genres")
+	assert.EqStr("0x5F", iepg.Genres[0].String(), "Genres[0]")
+	assert.EqStr("0x4F", iepg.Genres[1].String(), "Genres[1]")
+	assert.EqStr("1,2,0", iepg.Headers["copycontrol-1"], "Headers")
+	assert.EqInt(0, len(iepg.Warnings), "Warnings")
+}
+
+func TestParseIEpgs(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	list, err := ParseIEpgs(shiftJIS(testMultiIEpg))
+	assert.Nil(err, "ParseIEpgs should not return an error.")
+	assert.EqInt(2, len(list), "Number of programs")
+
+	p := list[0]
+	assert.EqInt(1, p.Version, "Version")
+	assert.EqStr("NHK総合", p.StationName, "StationName of iEPG 1")
+	assert.EqStr("深夜のドラマ", p.ProgramTitle, "ProgramTitle")
+	assert.EqStr("第1話", p.ProgramSubtitle, "ProgramSubtitle")
+	assert.EqStr("山田太郎", p.Performer, "Performer")
+	assert.Ok(time.Date(2014, 12, 5, 23, 30, 0, 0, jst).Equal(p.StartAt), "StartAt")
+	assert.Ok(time.Date(2014, 12, 6, 0, 30, 0, 0, jst).Equal(p.EndAt), "EndAt should be on the next day.")
+	assert.EqStr("0x30", p.Genres[0].String(), "Genre")
+	assert.EqStr("1行目\n2行目", string(p.Body), "Body")
+	assert.EqInt(1, len(p.Warnings), "Malformed lines should be warned.")
+	r := p.ToTvRecord()
+	assert.EqStr("第1話", r.Meta.Subtitle, "Meta.Subtitle")
+	assert.EqStr("山田太郎", r.Meta.Cast[0], "Meta.Cast")
+
+	p = list[1]
+	assert.EqInt(2, p.Version, "Version")
+	assert.EqInt(1234, p.ProgramId, "ProgramId")
+	assert.Ok(time.Date(2014, 12, 6, 1, 0, 0, 0, jst).Equal(p.StartAt), "StartAt after 24:00")
+	assert.Ok(time.Date(2014, 12, 6, 1, 30, 0, 0, jst).Equal(p.EndAt), "EndAt after 24:00")
+
+	_, err = ParseIEpgs(shiftJIS("version: 1\r\nstart: 25:00\r\n"))
+	assert.NotNil(err, "ParseIEpgs should return an error without the date.")
 }
+
+func shiftJIS(s string) *bytes.Buffer {
+	b, _ := ioutil.ReadAll(transform.NewReader(bytes.NewBufferString(s), japanese.ShiftJIS.NewEncoder()))
+	return bytes.NewBuffer(b)
+}
+
+var testMultiIEpg = "Content-type: application/x-tv-program-info; charset=shift_jis\r\n" +
+	"version: 1\r\n" +
+	"station: NHK総合\r\n" +
+	"year: 2014\r\n" +
+	"month: 12\r\n" +
+	"date: 05\r\n" +
+	"start: 23:30\r\n" +
+	"end: 00:30\r\n" +
+	"program-title: 深夜のドラマ\r\n" +
+	"program-subtitle: 第1話\r\n" +
+	"performer: 山田太郎\r\n" +
+	"genre: 3\r\n" +
+	"subgenre: 0\r\n" +
+	"malformed line\r\n" +
+	"\r\n" +
+	"1行目\r\n" +
+	"2行目\r\n" +
+	"\r\n" +
+	"Content-type: application/x-tv-program-digital-info; charset=shift_jis\r\n" +
+	"version: 2\r\n" +
+	"station: DFS00400\r\n" +
+	"station-name: 日本テレビ\r\n" +
+	"year: 2014\r\n" +
+	"month: 12\r\n" +
+	"date: 05\r\n" +
+	"start: 25:00\r\n" +
+	"end: 25:30\r\n" +
+	"program-title: 深夜番組\r\n" +
+	"program-id: 1234\r\n"
@@ -0,0 +1,192 @@
+package tv
+
+import (
+	"bytes"
+	"code.google.com/p/go.text/encoding/japanese"
+	"code.google.com/p/go.text/transform"
+	"fmt"
+	"github.com/speedland/lib/util/jptext"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	IEpgContentType        = "application/x-tv-program-info"
+	IEpgDigitalContentType = "application/x-tv-program-digital-info"
+)
+
+// NewIEpgFromTvRecord returns the IEpg to hand off the record to other
+// software. The channel is used for the station, and can be nil.
+func NewIEpgFromTvRecord(r *TvRecord, ch *TvChannel) *IEpg {
+	iepg := &IEpg{
+		Id:           r.IEpgId,
+		Version:      2,
+		ProgramTitle: r.Title,
+		StartAt:      r.StartAt,
+		EndAt:        r.EndAt,
+		Category:     r.Category,
+		Cid:          r.Cid,
+		Sid:          r.Sid,
+		Genres:       make([]GenreCode, 0),
+		Headers:      make(map[string]string),
+		Body:         make([]byte, 0),
+		CreatedAt:    r.CreatedAt,
+		UpdatedAt:    r.UpdatedAt,
+	}
+	if ch != nil {
+		iepg.StationId = ch.IEpgStationId
+		iepg.StationName = ch.Name
+	}
+	if r.Meta != nil {
+		iepg.ProgramSubtitle = r.Meta.Subtitle
+		iepg.Performer = strings.Join(r.Meta.Cast, "、")
+	}
+	return iepg
+}
+
+// WriteIEpg writes the program in Shift_JIS iEPG format. iEPG 1 is used if
+// iepg.Version is 1, otherwise iEPG 2.
+func WriteIEpg(w io.Writer, iepg *IEpg) error {
+	if iepg.EndAt.Sub(iepg.StartAt) >= 24*time.Hour {
+		return fmt.Errorf("Program longer than a day cannot be written in iEPG.")
+	}
+	var buff bytes.Buffer
+	header := func(key string, value string) {
+		buff.WriteString(key + ": " + value + "\r\n")
+	}
+	start, end := iepg.StartAt.In(jst), iepg.EndAt.In(jst)
+	if iepg.Version == 1 {
+		header("Content-type", IEpgContentType+"; charset=shift_jis")
+		header("version", "1")
+		header("station", iepg.StationName)
+	} else {
+		header("Content-type", IEpgDigitalContentType+"; charset=shift_jis")
+		header("version", "2")
+		header("station", iepg.StationId)
+		header("station-name", iepg.StationName)
+	}
+	header("year", fmt.Sprintf("%04d", start.Year()))
+	header("month", fmt.Sprintf("%02d", start.Month()))
+	header("date", fmt.Sprintf("%02d", start.Day()))
+	header("start", start.Format("15:04"))
+	header("end", end.Format("15:04"))
+	header("program-title", iepg.ProgramTitle)
+	if iepg.ProgramSubtitle != "" {
+		header("program-subtitle", iepg.ProgramSubtitle)
+	}
+	if iepg.Performer != "" {
+		header("performer", iepg.Performer)
+	}
+	if iepg.Version == 1 {
+		if len(iepg.Genres) > 0 {
+			header("genre", strconv.Itoa(iepg.Genres[0].Level1()))
+			header("subgenre", strconv.Itoa(iepg.Genres[0].Level2()))
+		}
+	} else {
+		if iepg.ProgramId != 0 {
+			header("program-id", strconv.Itoa(iepg.ProgramId))
+		}
+		for i, g := range iepg.Genres {
+			header(fmt.Sprintf("genre-%d", i+1), strconv.Itoa(g.Level1()))
+			header(fmt.Sprintf("subgenre-%d", i+1), strconv.Itoa(g.Level2()))
+		}
+	}
+	keys := make([]string, 0, len(iepg.Headers))
+	for k := range iepg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		header(k, iepg.Headers[k])
+	}
+	buff.WriteString("\r\n")
+	if len(iepg.Body) > 0 {
+		body := strings.Replace(string(iepg.Body), "\r\n", "\n", -1)
+		buff.WriteString(strings.Replace(body, "\n", "\r\n", -1) + "\r\n")
+	}
+	encoded, err := encodeShiftJIS(buff.Bytes())
+	if err != nil {
+		return fmt.Errorf("Could not encode iEPG in Shift_JIS: %v", err)
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+// shiftJISReplacement is written in place of the characters which Shift_JIS
+// cannot represent, such as ♥ or emoji.
+const shiftJISReplacement = "〓"
+
+// encodeShiftJIS encodes b in Shift_JIS. The ARIB symbols are folded into
+// the bracket forms and the other unsupported characters are replaced by
+// shiftJISReplacement so that a single character never fails the whole file.
+func encodeShiftJIS(b []byte) ([]byte, error) {
+	s := jptext.FoldSymbols(string(b))
+	if encoded, err := encodeShiftJISString(s); err == nil {
+		return encoded, nil
+	}
+	var buff bytes.Buffer
+	for _, r := range s {
+		encoded, err := encodeShiftJISString(string(r))
+		if err != nil {
+			if encoded, err = encodeShiftJISString(shiftJISReplacement); err != nil {
+				return nil, err
+			}
+		}
+		buff.Write(encoded)
+	}
+	return buff.Bytes(), nil
+}
+
+func encodeShiftJISString(s string) ([]byte, error) {
+	var buff bytes.Buffer
+	wio := transform.NewWriter(&buff, japanese.ShiftJIS.NewEncoder())
+	if _, err := wio.Write([]byte(s)); err != nil {
+		return nil, err
+	}
+	if err := wio.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// ServeIEpg writes the program as a downloadable iEPG file.
+func ServeIEpg(w http.ResponseWriter, iepg *IEpg) {
+	var buff bytes.Buffer
+	if err := WriteIEpg(&buff, iepg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ext := "tvpid"
+	if iepg.Version == 1 {
+		ext = "tvpi"
+	}
+	name := iepg.Id
+	if name == "" {
+		name = "program"
+	}
+	w.Header().Set("Content-Type", IEpgContentType+"; charset=shift_jis")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+ext))
+	w.Header().Set("Content-Length", strconv.Itoa(buff.Len()))
+	w.Write(buff.Bytes())
+}
+
+// IEpgHandler returns the handler which serves the program found by the
+// function, or responds 404 if it returns nil.
+func IEpgHandler(find func(req *http.Request) (*IEpg, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		iepg, err := find(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if iepg == nil {
+			http.NotFound(w, req)
+			return
+		}
+		ServeIEpg(w, iepg)
+	})
+}
@@ -0,0 +1,101 @@
+package tv
+
+import (
+	"bytes"
+	"github.com/speedland/wcg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteIEpg(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	file, _ := os.Open("./iepg-sample.iepg")
+	defer file.Close()
+	iepg, _ := ParseIEpg(file)
+
+	var buff bytes.Buffer
+	assert.Nil(WriteIEpg(&buff, iepg), "WriteIEpg should not return an error.")
+	parsed, err := ParseIEpg(&buff)
+	assert.Nil(err, "WriteIEpg should write a valid iEPG.")
+	assert.EqStr(iepg.ProgramTitle, parsed.ProgramTitle, "ProgramTitle")
+	assert.EqStr(iepg.StationId, parsed.StationId, "StationId")
+	assert.EqStr(iepg.StationName, parsed.StationName, "StationName")
+	assert.EqInt(iepg.ProgramId, parsed.ProgramId, "ProgramId")
+	assert.EqInt(2, len(parsed.Genres), "Genres")
+	assert.EqStr(string(iepg.Body), string(parsed.Body), "Body")
+	assert.EqStr(iepg.Headers["copycontrol-1"], parsed.Headers["copycontrol-1"], "Headers")
+	assert.Ok(iepg.StartAt.Equal(parsed.StartAt), "StartAt")
+	assert.Ok(iepg.EndAt.Equal(parsed.EndAt), "EndAt")
+}
+
+func TestWriteIEpg_UnsupportedCharacters(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	file, _ := os.Open("./iepg-sample.iepg")
+	defer file.Close()
+	iepg, _ := ParseIEpg(file)
+	iepg.ProgramTitle = "ラブ♥ドラマ\U0001F211"
+
+	var buff bytes.Buffer
+	assert.Nil(WriteIEpg(&buff, iepg), "WriteIEpg should not fail on the characters out of Shift_JIS.")
+	parsed, err := ParseIEpg(&buff)
+	assert.Nil(err, "WriteIEpg should write a valid iEPG.")
+	assert.EqStr("ラブ〓ドラマ【字】", parsed.ProgramTitle, "ProgramTitle")
+	assert.EqStr(iepg.StationId, parsed.StationId, "StationId")
+}
+
+func TestNewIEpgFromTvRecord(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	start := time.Date(2014, 12, 5, 23, 30, 0, 0, jst)
+	r := NewTvRecord("深夜のドラマ", "drama", start, start.Add(time.Hour), "GR5", "1064", "me")
+	r.Meta = &ProgramMeta{Subtitle: "第1話", Cast: []string{"山田太郎", "鈴木花子"}}
+	ch := &TvChannel{Cid: "GR5", Sid: "1064", Name: "テレビ朝日", IEpgStationId: "DFS00428"}
+
+	iepg := NewIEpgFromTvRecord(r, ch)
+	iepg.Version = 1
+	var buff bytes.Buffer
+	assert.Nil(WriteIEpg(&buff, iepg), "WriteIEpg should not return an error.")
+	parsed, err := ParseIEpg(&buff)
+	assert.Nil(err, "WriteIEpg should write a valid iEPG 1.")
+	assert.EqInt(1, parsed.Version, "Version")
+	assert.EqStr("テレビ朝日", parsed.StationName, "Station of iEPG 1")
+	assert.EqStr("第1話", parsed.ProgramSubtitle, "ProgramSubtitle")
+	assert.EqStr("山田太郎、鈴木花子", parsed.Performer, "Performer")
+	assert.Ok(r.EndAt.Equal(parsed.EndAt), "EndAt crossing the midnight")
+
+	iepg.ProgramTitle = "☃"
+	buff.Reset()
+	assert.Nil(WriteIEpg(&buff, iepg), "WriteIEpg should replace characters not in Shift_JIS.")
+	parsed, err = ParseIEpg(&buff)
+	assert.Nil(err, "WriteIEpg should write a valid iEPG 1.")
+	assert.EqStr("〓", parsed.ProgramTitle, "ProgramTitle")
+}
+
+func TestIEpgHandler(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	start := time.Date(2014, 12, 5, 1, 0, 0, 0, jst)
+	r := NewTvRecord("番組", "etc", start, start.Add(time.Hour), "GR5", "1064", "me")
+	handler := IEpgHandler(func(req *http.Request) (*IEpg, error) {
+		if req.URL.Path != "/found" {
+			return nil, nil
+		}
+		iepg := NewIEpgFromTvRecord(r, nil)
+		iepg.Id = "123"
+		return iepg, nil
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/found", nil))
+	assert.EqInt(200, w.Code, "Status")
+	assert.EqStr("application/x-tv-program-info; charset=shift_jis", w.Header().Get("Content-Type"), "Content-Type")
+	assert.EqStr(`attachment; filename="123.tvpid"`, w.Header().Get("Content-Disposition"), "Content-Disposition")
+	parsed, err := ParseIEpg(w.Body)
+	assert.Nil(err, "Response should be a valid iEPG.")
+	assert.EqStr("番組", parsed.ProgramTitle, "ProgramTitle")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/notfound", nil))
+	assert.EqInt(404, w.Code, "Status for not found")
+}
@@ -0,0 +1,99 @@
+package tv
+
+import (
+	"github.com/speedland/lib/util/jptext"
+	"regexp"
+	"strings"
+)
+
+// ProgramMeta is the metadata of a program derived from its texts.
+type ProgramMeta struct {
+	SeriesTitle string       `json:"series_title"`
+	Episode     int          `json:"episode"` // 0 if unknown
+	Subtitle    string       `json:"subtitle"`
+	Flags       jptext.Flags `json:"flags"`
+	Cast        []string     `json:"cast"`
+}
+
+// Keys of ExtDetails which have the cast names.
+var CastDetailKeys = []string{"出演者", "出演", "声の出演", "キャスト"}
+
+// Keys of ExtDetails which have the program description used when Detail is empty.
+var ContentDetailKeys = []string{"番組内容"}
+
+var (
+	metaSubtitleRegexp = regexp.MustCompile(`「([^「」]+)」`)
+	metaLabelRegexp    = regexp.MustCompile(`^(【[^】]*】|[^：:]{1,10}[：:])\s*`)
+	metaCastSeparator  = regexp.MustCompile(`[、，,／/]+`)
+)
+
+// ExtractProgramMeta derives the metadata from the title, the detail and the
+// extended details of a program. Subtitles are taken from 「」 or after ▽ in
+// the title, or from 「」 in the description.
+func ExtractProgramMeta(title string, detail string, ext map[string]string) *ProgramMeta {
+	meta := &ProgramMeta{
+		Cast: make([]string, 0),
+	}
+	title, meta.Flags = jptext.ExtractFlags(title)
+	if detail == "" {
+		for _, key := range ContentDetailKeys {
+			if v, ok := ext[key]; ok {
+				detail = v
+				break
+			}
+		}
+	}
+	detail = jptext.Normalize(detail)
+
+	series := title
+	if i := strings.Index(series, "▽"); i >= 0 {
+		meta.Subtitle = strings.TrimSpace(strings.Trim(series[i:], "▽ "))
+		if j := strings.Index(meta.Subtitle, "▽"); j >= 0 {
+			meta.Subtitle = strings.TrimSpace(meta.Subtitle[:j])
+		}
+		series = series[:i]
+	}
+	if m := metaSubtitleRegexp.FindStringSubmatch(series); m != nil {
+		meta.Subtitle = strings.TrimSpace(m[1])
+		series = metaSubtitleRegexp.ReplaceAllString(series, " ")
+	} else if meta.Subtitle == "" {
+		if m := metaSubtitleRegexp.FindStringSubmatch(detail); m != nil {
+			meta.Subtitle = strings.TrimSpace(m[1])
+		}
+	}
+	if n, ok := jptext.Episode(title); ok {
+		meta.Episode = n
+	} else if n, ok := jptext.Episode(detail); ok {
+		meta.Episode = n
+	}
+	meta.SeriesTitle = jptext.RemoveEpisode(jptext.Normalize(series))
+
+	for _, key := range CastDetailKeys {
+		if v, ok := ext[key]; ok {
+			meta.Cast = appendCast(meta.Cast, v)
+		}
+	}
+	return meta
+}
+
+func appendCast(cast []string, value string) []string {
+	// Normalize joins lines with spaces, which are also in names.
+	value = jptext.Normalize(strings.Replace(value, "\n", "、", -1))
+	for _, name := range metaCastSeparator.Split(value, -1) {
+		name = strings.TrimSpace(metaLabelRegexp.ReplaceAllString(strings.TrimSpace(name), ""))
+		if name == "" || containsString(cast, name) {
+			continue
+		}
+		cast = append(cast, name)
+	}
+	return cast
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+)
+
+func TestExtractProgramMeta(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	meta := ExtractProgramMeta(
+		"【新】ドラマ１０　第３話「運命の日」【字】【再】",
+		"",
+		map[string]string{
+			"番組内容": "主人公が決断する。",
+			"出演者":  "【出演】山田太郎、鈴木花子\n【語り】ジョン・スミス",
+		},
+	)
+	assert.EqStr("ドラマ10", meta.SeriesTitle, "SeriesTitle")
+	assert.EqInt(3, meta.Episode, "Episode")
+	assert.EqStr("運命の日", meta.Subtitle, "Subtitle")
+	assert.Ok(meta.Flags.New && meta.Flags.Rerun && meta.Flags.Subtitled, "Flags")
+	assert.EqInt(3, len(meta.Cast), "Cast")
+	assert.EqStr("山田太郎", meta.Cast[0], "Cast[0]")
+	assert.EqStr("ジョン・スミス", meta.Cast[2], "Cast[2]")
+
+	meta = ExtractProgramMeta(
+		"The　Girls　Live　▽道重さゆみ卒業ライブに密着▽LoVendoЯスタジオライブ",
+		"#12 「最終回」", nil,
+	)
+	assert.EqStr("The Girls Live", meta.SeriesTitle, "SeriesTitle with ▽")
+	assert.EqStr("道重さゆみ卒業ライブに密着", meta.Subtitle, "Subtitle after ▽")
+	assert.EqInt(12, meta.Episode, "Episode in the detail")
+	assert.EqInt(0, len(meta.Cast), "Cast")
+
+	meta = ExtractProgramMeta("アニメ　第十二回", "", nil)
+	assert.EqStr("アニメ", meta.SeriesTitle, "SeriesTitle without the episode in kanji")
+	assert.EqInt(12, meta.Episode, "Episode in kanji")
+}
+
+func TestEpg_ToTvRecord_Meta(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	list, _ := ParseEpgJsonString(testJson)
+	assert.NotNil(list[0].Meta, "Meta should be extracted on parsing.")
+	assert.Ok(list[0].Meta.Flags.Subtitled, "Meta.Flags")
+	r := list[0].ToTvRecord("news", "me")
+	assert.Ok(r.Meta == list[0].Meta, "Meta should be carried into the record.")
+}
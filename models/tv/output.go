@@ -0,0 +1,171 @@
+package tv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Default template of the output path relative to the base directory.
+var DefaultOutputTemplate = "{{.Category}}/{{.StartAt}}_{{.Title}}.ts"
+
+// Category used in the output path if the category of the record is empty.
+var DefaultOutputCategory = "etc"
+
+const output_time_layout = "20060102-1504"
+
+// OutputManager derives the output file paths of TvRecords.
+type OutputManager struct {
+	BaseDir  string
+	template *template.Template
+	mutex    sync.Mutex
+}
+
+// Parameters available in the output template.
+// Title and Category are sanitized and times are formatted as 20060102-1504.
+type OutputParams struct {
+	Id       string
+	Title    string
+	Category string
+	Cid      string
+	Sid      string
+	StartAt  string
+	EndAt    string
+}
+
+func NewOutputManager(dir string, tmpl string) (*OutputManager, error) {
+	if tmpl == "" {
+		tmpl = DefaultOutputTemplate
+	}
+	t, err := template.New("output").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse output template %q: %v", tmpl, err)
+	}
+	return &OutputManager{
+		BaseDir:  dir,
+		template: t,
+	}, nil
+}
+
+// Path returns the path of the first segment for the record.
+func (m *OutputManager) Path(rec *TvRecord) (string, error) {
+	var buff bytes.Buffer
+	category := SanitizeFileName(rec.Category)
+	if category == "" {
+		category = DefaultOutputCategory
+	}
+	params := &OutputParams{
+		Id:       rec.Id,
+		Title:    SanitizeFileName(rec.Title),
+		Category: category,
+		Cid:      SanitizeFileName(rec.Cid),
+		Sid:      SanitizeFileName(rec.Sid),
+		StartAt:  rec.StartAt.In(jst).Format(output_time_layout),
+		EndAt:    rec.EndAt.In(jst).Format(output_time_layout),
+	}
+	if err := m.template.Execute(&buff, params); err != nil {
+		return "", fmt.Errorf("Could not build the output path for %v: %v", rec, err)
+	}
+	p := filepath.Clean(buff.String())
+	if filepath.IsAbs(p) || strings.HasPrefix(p, "..") {
+		return "", fmt.Errorf("Output path %q for %v is out of the base directory.", p, rec)
+	}
+	return filepath.Join(m.BaseDir, p), nil
+}
+
+// NextSegment allocates a path for a new segment of the record and appends
+// it to rec.Files. RecordCtrl calls this before every (re)start of a
+// TvRecordProvider if Recorder.Output is set, and the Record should write
+// to rec.CurrentFile().
+func (m *OutputManager) NextSegment(rec *TvRecord) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p, err := m.Path(rec)
+	if err != nil {
+		return "", err
+	}
+	if len(rec.Files) > 0 {
+		p = withSuffix(p, fmt.Sprintf(".%d", len(rec.Files)))
+	}
+	p = m.avoidCollision(p)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", fmt.Errorf("Could not create the output directory for %v: %v", rec, err)
+	}
+	// reserve the file so that other records do not take the same path.
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", fmt.Errorf("Could not create the output file for %v: %v", rec, err)
+	}
+	f.Close()
+	rec.Files = append(rec.Files, p)
+	return p, nil
+}
+
+// discardSegment removes the segment p which has not been recorded.
+func (m *OutputManager) discardSegment(rec *TvRecord, p string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if n := len(rec.Files); n > 0 && rec.Files[n-1] == p {
+		rec.Files = rec.Files[:n-1]
+	}
+	if info, err := os.Stat(p); err == nil && info.Size() == 0 {
+		os.Remove(p)
+	}
+}
+
+// UpdateSize stores the total size of rec.Files into rec.Size.
+func (m *OutputManager) UpdateSize(rec *TvRecord) error {
+	var size int64
+	for _, p := range rec.Files {
+		info, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		size += info.Size()
+	}
+	rec.Size = size
+	return nil
+}
+
+func (m *OutputManager) avoidCollision(p string) string {
+	candidate := p
+	for i := 1; ; i++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = withSuffix(p, fmt.Sprintf("-%d", i))
+	}
+}
+
+func withSuffix(p string, suffix string) string {
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + suffix + ext
+}
+
+// SanitizeFileName makes the string safe to be used as a file name.
+// Control characters are removed and symbols which are not safe on file
+// systems are replaced with full-width characters, as IEpg.ToTvRecord does for "/".
+func SanitizeFileName(s string) string {
+	var buff bytes.Buffer
+	for _, r := range s {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			continue
+		case strings.ContainsRune("\"#$%&'*,/:;<>?\\|", r):
+			buff.WriteRune(r + 0xfee0) // full-width form
+		default:
+			buff.WriteRune(r)
+		}
+	}
+	return strings.Trim(buff.String(), " .")
+}
+
+var jst = time.FixedZone("JST", 9*60*60)
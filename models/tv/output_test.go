@@ -0,0 +1,120 @@
+package tv
+
+import (
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	assert.EqStr("AC／DC：Live？", SanitizeFileName("AC/DC:Live?"), "Symbols should be full-width.")
+	assert.EqStr("foo", SanitizeFileName("..foo\x00\n"), "Control characters and dots should be removed.")
+	assert.EqStr("モーニング娘。", SanitizeFileName("モーニング娘。"), "Japanese should be kept.")
+}
+
+func TestOutputManager(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	util.WithTempDir(func(dir string) {
+		m, err := NewOutputManager(dir, "")
+		assert.Nil(err, "NewOutputManager should not return an error.")
+		r := genTestRecord()
+		r.Title = "AC/DC"
+		r.Category = "Music"
+		r.StartAt = time.Date(2014, 12, 5, 1, 0, 0, 0, jst)
+
+		p, err := m.Path(r)
+		assert.Nil(err, "Path should not return an error.")
+		assert.EqStr(filepath.Join(dir, "Music", "20141205-0100_AC／DC.ts"), p, "Path")
+
+		p1, err := m.NextSegment(r)
+		assert.Nil(err, "NextSegment should not return an error.")
+		assert.EqStr(p, p1, "1st segment should be Path.")
+		p2, err := m.NextSegment(r)
+		assert.Nil(err, "NextSegment should not return an error.")
+		assert.EqStr(filepath.Join(dir, "Music", "20141205-0100_AC／DC.1.ts"), p2, "2nd segment")
+		assert.EqInt(2, len(r.Files), "Files should have 2 segments.")
+
+		// another record with the same title and time.
+		r2 := genTestRecord()
+		r2.Title = r.Title
+		r2.Category = r.Category
+		r2.StartAt = r.StartAt
+		p3, err := m.NextSegment(r2)
+		assert.Nil(err, "NextSegment should not return an error.")
+		assert.EqStr(filepath.Join(dir, "Music", "20141205-0100_AC／DC-1.ts"), p3, "Path should not collide.")
+
+		ioutil.WriteFile(p1, []byte("12345"), 0644)
+		ioutil.WriteFile(p2, []byte("123"), 0644)
+		assert.Nil(m.UpdateSize(r), "UpdateSize should not return an error.")
+		assert.Ok(r.Size == 8, "Size should be the total of segments.")
+	})
+}
+
+type segmentRecord struct {
+	*DummyRecord
+	rec     *TvRecord
+	running bool
+}
+
+func (r *segmentRecord) Start() error {
+	r.running = true
+	return ioutil.WriteFile(r.rec.CurrentFile(), []byte("12345"), 0644)
+}
+
+func (r *segmentRecord) Stop() error {
+	r.running = false
+	return nil
+}
+
+func (r *segmentRecord) IsRunning() bool {
+	return r.running
+}
+
+func (r *segmentRecord) GetTvRecord() *TvRecord {
+	return r.rec
+}
+
+func TestOutputManager_Restart(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	util.WithTempDir(func(dir string) {
+		m, _ := NewOutputManager(dir, "")
+		now := time.Now()
+		rec := genTestRecord()
+		rec.Category = ".."
+		rec.StartAt = time.Date(2014, 12, 5, 1, 0, 0, 0, jst)
+		r := &segmentRecord{DummyRecord: NewDummyRecord(rec.Id), rec: rec}
+		r.startAt = now
+		r.endAt = now.Add(30 * time.Minute)
+		ctrl := NewRecordCtrl(r)
+		ctrl.output = m
+
+		ctrl.control(now)
+		assert.EqInt(int(RSRecording), int(ctrl.state), "Recording should be started.")
+		assert.EqInt(1, len(rec.Files), "1st segment should be allocated.")
+		assert.EqStr(filepath.Join(dir, "etc", "20141205-0100_title.ts"), rec.Files[0], "Empty category should be the default.")
+
+		r.running = false // the process died.
+		ctrl.control(now.Add(1 * time.Minute))
+		assert.EqInt(1, ctrl.restarts, "Recording should be restarted.")
+		assert.EqInt(2, len(rec.Files), "2nd segment should be allocated on restart.")
+		assert.EqStr(filepath.Join(dir, "etc", "20141205-0100_title.1.ts"), rec.Files[1], "2nd segment")
+
+		ctrl.control(now.Add(30 * time.Minute))
+		assert.EqInt(int(RSSucceeded), int(ctrl.state), "Recording should be succeeded.")
+		assert.Ok(rec.Size == 10, "Size should be the total of segments.")
+	})
+}
+
+func TestOutputManager_InvalidTemplate(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	_, err := NewOutputManager("/tmp", "{{.Title")
+	assert.NotNil(err, "NewOutputManager should return an error for invalid template.")
+
+	m, _ := NewOutputManager("/tmp", "../{{.Title}}.ts")
+	_, err = m.Path(genTestRecord())
+	assert.NotNil(err, "Path should not go out of the base directory.")
+}
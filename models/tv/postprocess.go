@@ -0,0 +1,380 @@
+package tv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type PostProcessState int
+
+var (
+	PPRunning   = PostProcessState(1)
+	PPSucceeded = PostProcessState(2)
+	PPFailed    = PostProcessState(3)
+)
+
+// PostProcessStatus is the status of a step reported on TvRecord.PostProcess.
+type PostProcessStatus struct {
+	Step      string           `json:"step"`
+	State     PostProcessState `json:"state"`
+	Attempts  int              `json:"attempts"`
+	Error     string           `json:"error"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// PostStep is a step to process the recorded files.
+type PostStep interface {
+	Name() string
+	Run(rec *TvRecord) error
+}
+
+// TvRecordProvider is implemented by a Record which is backed by a TvRecord
+// so that the recorded files can be processed after the recording.
+type TvRecordProvider interface {
+	GetTvRecord() *TvRecord
+}
+
+// PostPipeline runs the steps in order after the recording succeeded.
+// The pipeline stops at the step which fails after all retries.
+type PostPipeline struct {
+	// Called when the pipeline is done, with the error of the failed step.
+	OnProcessed func(rec *TvRecord, err error)
+	steps       []*postStepConfig
+	logger      wcg.Logger
+}
+
+type postStepConfig struct {
+	step     PostStep
+	retries  int
+	interval time.Duration
+}
+
+func NewPostPipeline() *PostPipeline {
+	return &PostPipeline{
+		steps:  make([]*postStepConfig, 0),
+		logger: util.GetLogger(),
+	}
+}
+
+// Add appends the step which is retried up to `retries` times with the interval.
+func (p *PostPipeline) Add(step PostStep, retries int, interval time.Duration) *PostPipeline {
+	p.steps = append(p.steps, &postStepConfig{
+		step:     step,
+		retries:  retries,
+		interval: interval,
+	})
+	return p
+}
+
+// Listen registers the pipeline to process the records succeeded in the recorder.
+// Other listeners should not read the TvRecord of a succeeded result since it
+// is updated by the pipeline in another goroutine.
+func (p *PostPipeline) Listen(r *Recorder) {
+	r.OnResult(func(result *RecordResult) {
+		if result.State != RSSucceeded {
+			return
+		}
+		provider, ok := result.Record.(TvRecordProvider)
+		if !ok {
+			p.logger.Warn("%v: Post processing is skipped since the record is not a TvRecordProvider.", result.Record)
+			return
+		}
+		go p.Process(provider.GetTvRecord())
+	})
+}
+
+// Process runs all steps on the record and reports the statuses on rec.PostProcess.
+func (p *PostPipeline) Process(rec *TvRecord) error {
+	var err error
+	for _, c := range p.steps {
+		status := &PostProcessStatus{
+			Step:      c.step.Name(),
+			State:     PPRunning,
+			UpdatedAt: time.Now(),
+		}
+		rec.PostProcess = append(rec.PostProcess, status)
+		for status.Attempts <= c.retries {
+			if status.Attempts > 0 {
+				time.Sleep(c.interval)
+			}
+			status.Attempts += 1
+			if err = c.step.Run(rec); err == nil {
+				break
+			}
+			p.logger.Warn("%v: Post processing %q failed (%d) - %v", rec, status.Step, status.Attempts, err)
+		}
+		status.UpdatedAt = time.Now()
+		if err != nil {
+			status.State = PPFailed
+			status.Error = err.Error()
+			break
+		}
+		status.State = PPSucceeded
+		status.Error = ""
+	}
+	if err == nil {
+		p.logger.Info("%v: Post processing completed.", rec)
+	}
+	if p.OnProcessed != nil {
+		p.OnProcessed(rec, err)
+	}
+	return err
+}
+
+// IntegrityCheck verifies the recorded files by their size and duration.
+type IntegrityCheck struct {
+	MinBitrate int64 // bytes per second of RecordTime
+	// Returns the total duration of the files, or nil to skip the duration check.
+	Probe     func(files []string) (time.Duration, error)
+	Tolerance time.Duration // acceptable shortage of the duration
+}
+
+func (s *IntegrityCheck) Name() string {
+	return "integrity"
+}
+
+func (s *IntegrityCheck) Run(rec *TvRecord) error {
+	if len(rec.Files) == 0 {
+		return fmt.Errorf("No files are recorded.")
+	}
+	var size int64
+	for _, p := range rec.Files {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+	}
+	rec.Size = size
+	min := int64(rec.RecordTime()/time.Second) * s.MinBitrate
+	if size == 0 || size < min {
+		return fmt.Errorf("Recorded size %d bytes is less than expected %d bytes.", size, min)
+	}
+	if s.Probe != nil {
+		d, err := s.Probe(rec.Files)
+		if err != nil {
+			return fmt.Errorf("Could not probe the duration: %v", err)
+		}
+		if d+s.Tolerance < rec.RecordTime() {
+			return fmt.Errorf("Recorded duration %v is shorter than %v.", d, rec.RecordTime())
+		}
+	}
+	return nil
+}
+
+// CommandProbe returns a Probe function which runs the command for each
+// file and parses the stdout as seconds, e.g.
+//
+//	CommandProbe("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0")
+func CommandProbe(name string, args ...string) func([]string) (time.Duration, error) {
+	return func(files []string) (time.Duration, error) {
+		var total time.Duration
+		for _, f := range files {
+			out, err := exec.Command(name, append(args, f)...).Output()
+			if err != nil {
+				return 0, err
+			}
+			sec, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+			if err != nil {
+				return 0, fmt.Errorf("Could not parse the duration %q of %q", out, f)
+			}
+			total += time.Duration(sec * float64(time.Second))
+		}
+		return total, nil
+	}
+}
+
+// CommandStep runs an external command (transcoding, thumbnail extraction, ...)
+// for each recorded file. Args and Output are templates with the parameters
+// {{.Input}}, {{.Dir}}, {{.Base}} (the file name without extension),
+// {{.Title}}, {{.Id}} and {{.Output}} (only in Args).
+// The outputs are stored in rec.Artifacts under the step name.
+type CommandStep struct {
+	StepName string
+	Command  string
+	Args     []string
+	Output   string
+}
+
+type commandParams struct {
+	Input  string
+	Dir    string
+	Base   string
+	Title  string
+	Id     string
+	Output string
+}
+
+func (s *CommandStep) Name() string {
+	return s.StepName
+}
+
+func (s *CommandStep) Run(rec *TvRecord) error {
+	outputs := make([]string, 0)
+	for _, f := range rec.Files {
+		params := &commandParams{
+			Input: f,
+			Dir:   filepath.Dir(f),
+			Base:  strings.TrimSuffix(filepath.Base(f), filepath.Ext(f)),
+			Title: SanitizeFileName(rec.Title),
+			Id:    rec.Id,
+		}
+		if s.Output != "" {
+			output, err := execTemplate(s.Output, params)
+			if err != nil {
+				return err
+			}
+			params.Output = output
+		}
+		args := make([]string, len(s.Args))
+		for i, a := range s.Args {
+			arg, err := execTemplate(a, params)
+			if err != nil {
+				return err
+			}
+			args[i] = arg
+		}
+		if out, err := exec.Command(s.Command, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %v: %v (%q)", s.Command, args, err, out)
+		}
+		if params.Output != "" {
+			outputs = append(outputs, params.Output)
+		}
+	}
+	if len(outputs) > 0 {
+		if rec.Artifacts == nil {
+			rec.Artifacts = make(map[string][]string)
+		}
+		rec.Artifacts[s.StepName] = outputs
+	}
+	return nil
+}
+
+func execTemplate(tmpl string, params interface{}) (string, error) {
+	t, err := template.New("").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse template %q: %v", tmpl, err)
+	}
+	var buff bytes.Buffer
+	if err := t.Execute(&buff, params); err != nil {
+		return "", fmt.Errorf("Could not execute template %q: %v", tmpl, err)
+	}
+	return buff.String(), nil
+}
+
+// ChecksumStep stores the SHA-256 of each file in rec.Checksums keyed by the file name.
+type ChecksumStep struct{}
+
+func (s *ChecksumStep) Name() string {
+	return "checksum"
+}
+
+func (s *ChecksumStep) Run(rec *TvRecord) error {
+	checksums := make(map[string]string)
+	for _, p := range rec.Files {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		checksums[filepath.Base(p)] = hex.EncodeToString(h.Sum(nil))
+	}
+	rec.Checksums = checksums
+	return nil
+}
+
+// MoveStep moves the recorded files from BaseDir into LibraryDir keeping
+// the relative paths, and updates rec.Files. Existing files in the library
+// are not overwritten, a numbered suffix is added to the moved file instead.
+type MoveStep struct {
+	BaseDir    string
+	LibraryDir string
+}
+
+func (s *MoveStep) Name() string {
+	return "move"
+}
+
+func (s *MoveStep) Run(rec *TvRecord) error {
+	for i, p := range rec.Files {
+		rel, err := filepath.Rel(s.BaseDir, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(p)
+		}
+		dst := filepath.Join(s.LibraryDir, rel)
+		if dst == p {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if dst, err = moveFile(p, dst); err != nil {
+			return err
+		}
+		rec.Files[i] = dst
+	}
+	return nil
+}
+
+// moveFile moves src to dst, or dst with a numbered suffix if it exists,
+// and returns the path moved to.
+func moveFile(src, dst string) (string, error) {
+	out, path, err := createNewFile(dst)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, path); err == nil {
+		out.Close()
+		return path, nil
+	}
+	// copy for another device.
+	in, err := os.Open(src)
+	if err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	defer in.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Remove(src)
+}
+
+// createNewFile creates p exclusively, or p with a numbered suffix if it
+// exists, as OutputManager avoids collisions.
+func createNewFile(p string) (*os.File, string, error) {
+	candidate := p
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(candidate, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return f, candidate, nil
+		}
+		if !os.IsExist(err) {
+			return nil, "", err
+		}
+		candidate = withSuffix(p, fmt.Sprintf("-%d", i))
+	}
+}
@@ -0,0 +1,108 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type flakyStep struct {
+	failures int
+	runs     int
+}
+
+func (s *flakyStep) Name() string {
+	return "flaky"
+}
+
+func (s *flakyStep) Run(rec *TvRecord) error {
+	s.runs += 1
+	if s.runs <= s.failures {
+		return fmt.Errorf("failure %d", s.runs)
+	}
+	return nil
+}
+
+func TestPostPipeline(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	util.WithTempDir(func(dir string) {
+		rec := genTestRecord()
+		rec.EndAt = rec.StartAt.Add(10 * time.Second)
+		src := filepath.Join(dir, "rec", "category", "a.ts")
+		os.MkdirAll(filepath.Dir(src), 0755)
+		ioutil.WriteFile(src, []byte("0123456789"), 0644)
+		rec.Files = []string{src}
+
+		flaky := &flakyStep{failures: 1}
+		p := NewPostPipeline().
+			Add(&IntegrityCheck{MinBitrate: 1}, 0, 0).
+			Add(flaky, 1, 0).
+			Add(&ChecksumStep{}, 0, 0).
+			Add(&MoveStep{BaseDir: filepath.Join(dir, "rec"), LibraryDir: filepath.Join(dir, "lib")}, 0, 0)
+		err := p.Process(rec)
+		assert.Nil(err, "Process should not return an error.")
+		assert.EqInt(4, len(rec.PostProcess), "All steps should be reported.")
+		assert.EqInt(2, rec.PostProcess[1].Attempts, "flaky step should be retried.")
+		assert.EqInt(int(PPSucceeded), int(rec.PostProcess[1].State), "flaky step should be succeeded.")
+		assert.EqStr(
+			"84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882",
+			rec.Checksums["a.ts"], "Checksum",
+		)
+		assert.EqStr(filepath.Join(dir, "lib", "category", "a.ts"), rec.Files[0], "File should be moved.")
+		_, err = os.Stat(rec.Files[0])
+		assert.Nil(err, "File should exist in the library.")
+	})
+}
+
+func TestMoveStep_Collision(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	util.WithTempDir(func(dir string) {
+		rec := genTestRecord()
+		src := filepath.Join(dir, "rec", "a.ts")
+		os.MkdirAll(filepath.Dir(src), 0755)
+		ioutil.WriteFile(src, []byte("new"), 0644)
+		rec.Files = []string{src}
+		existing := filepath.Join(dir, "lib", "a.ts")
+		os.MkdirAll(filepath.Dir(existing), 0755)
+		ioutil.WriteFile(existing, []byte("old"), 0644)
+
+		step := &MoveStep{BaseDir: filepath.Join(dir, "rec"), LibraryDir: filepath.Join(dir, "lib")}
+		assert.Nil(step.Run(rec), "Run should not return an error.")
+		assert.EqStr(filepath.Join(dir, "lib", "a-1.ts"), rec.Files[0], "File should be moved with a suffix.")
+		buff, _ := ioutil.ReadFile(existing)
+		assert.EqStr("old", string(buff), "Existing file should not be overwritten.")
+		buff, _ = ioutil.ReadFile(rec.Files[0])
+		assert.EqStr("new", string(buff), "File should be moved.")
+		_, err := os.Stat(src)
+		assert.Ok(os.IsNotExist(err), "Source should be removed.")
+	})
+}
+
+func TestPostPipeline_Failure(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	util.WithTempDir(func(dir string) {
+		rec := genTestRecord()
+		src := filepath.Join(dir, "a.ts")
+		ioutil.WriteFile(src, []byte("0123456789"), 0644)
+		rec.Files = []string{src}
+
+		var processed error
+		p := NewPostPipeline().
+			Add(&IntegrityCheck{MinBitrate: 1}, 2, 0).
+			Add(&ChecksumStep{}, 0, 0)
+		p.OnProcessed = func(r *TvRecord, err error) {
+			processed = err
+		}
+		err := p.Process(rec)
+		assert.NotNil(err, "Process should return an error since the file is too small.")
+		assert.NotNil(processed, "OnProcessed should be called with the error.")
+		assert.EqInt(1, len(rec.PostProcess), "Pipeline should stop at the failed step.")
+		assert.EqInt(3, rec.PostProcess[0].Attempts, "Failed step should be retried.")
+		assert.EqInt(int(PPFailed), int(rec.PostProcess[0].State), "Step should be failed.")
+	})
+}
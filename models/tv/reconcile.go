@@ -0,0 +1,103 @@
+package tv
+
+import (
+	"fmt"
+	"time"
+)
+
+type RecordChangeType int
+
+var (
+	RCMoved    = RecordChangeType(1) // the event has been moved.
+	RCCanceled = RecordChangeType(2) // the event no longer exists in the EPG.
+)
+
+// RecordChange is a change log entry made by ReconcileRecords.
+type RecordChange struct {
+	Type       RecordChangeType
+	Record     *TvRecord
+	OldStartAt time.Time
+	OldEndAt   time.Time
+}
+
+func (c *RecordChange) String() string {
+	switch c.Type {
+	case RCMoved:
+		return fmt.Sprintf("%v (%s, event: %d) moved: %s - %s -> %s - %s",
+			c.Record, c.Record.Title, c.Record.EventId,
+			c.OldStartAt.In(jst).Format(change_time_layout), c.OldEndAt.In(jst).Format(change_time_layout),
+			c.Record.StartAt.In(jst).Format(change_time_layout), c.Record.EndAt.In(jst).Format(change_time_layout),
+		)
+	case RCCanceled:
+		return fmt.Sprintf("%v (%s, event: %d) canceled", c.Record, c.Record.Title, c.Record.EventId)
+	default:
+		return fmt.Sprintf("%v unknown change", c.Record)
+	}
+}
+
+const change_time_layout = "2006-01-02 15:04"
+
+// ReconcileRecords follows the changes of EPG events for the records which
+// have not ended yet. Records are matched with events by Cid, Sid and
+// EventId, and StartAt/EndAt are updated when the event has moved. A record
+// is reported as canceled when the EPG covers its time range on the channel
+// but does not have the event. Canceled records are not modified.
+func ReconcileRecords(records []*TvRecord, epgs []*Epg, now time.Time) []*RecordChange {
+	type channelEpgs struct {
+		events  map[int]*Epg
+		startAt time.Time
+		endAt   time.Time
+	}
+	channels := make(map[string]*channelEpgs)
+	for _, epg := range epgs {
+		key := epg.Cid + "_" + epg.Sid
+		ch, ok := channels[key]
+		if !ok {
+			ch = &channelEpgs{events: make(map[int]*Epg), startAt: epg.StartAt, endAt: epg.EndAt}
+			channels[key] = ch
+		}
+		ch.events[epg.EventId] = epg
+		if epg.StartAt.Before(ch.startAt) {
+			ch.startAt = epg.StartAt
+		}
+		if epg.EndAt.After(ch.endAt) {
+			ch.endAt = epg.EndAt
+		}
+	}
+
+	changes := make([]*RecordChange, 0)
+	for _, r := range records {
+		if r.EventId == 0 || !r.EndAt.After(now) {
+			continue
+		}
+		ch, ok := channels[r.Cid+"_"+r.Sid]
+		if !ok {
+			continue
+		}
+		epg, ok := ch.events[r.EventId]
+		if !ok {
+			if !ch.startAt.After(r.StartAt) && !ch.endAt.Before(r.EndAt) {
+				changes = append(changes, &RecordChange{
+					Type:       RCCanceled,
+					Record:     r,
+					OldStartAt: r.StartAt,
+					OldEndAt:   r.EndAt,
+				})
+			}
+			continue
+		}
+		if epg.StartAt.Equal(r.StartAt) && epg.EndAt.Equal(r.EndAt) {
+			continue
+		}
+		changes = append(changes, &RecordChange{
+			Type:       RCMoved,
+			Record:     r,
+			OldStartAt: r.StartAt,
+			OldEndAt:   r.EndAt,
+		})
+		r.StartAt = epg.StartAt
+		r.EndAt = epg.EndAt
+		r.UpdatedAt = now
+	}
+	return changes
+}
@@ -0,0 +1,37 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+	"time"
+)
+
+func TestReconcileRecords(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	now := time.Date(2014, 12, 4, 0, 0, 0, 0, jst)
+	epgs := genTestEpgs()
+	moved := epgs[0].ToTvRecord("music", "me")
+	kept := epgs[1].ToTvRecord("music", "me")
+	canceled := epgs[2].ToTvRecord("news", "me")
+	canceled.EventId = 999
+	unknown := epgs[2].ToTvRecord("news", "me")
+	unknown.Cid = "BS15"
+
+	// sports overrun
+	epgs[0].StartAt = epgs[0].StartAt.Add(30 * time.Minute)
+	epgs[0].EndAt = epgs[0].EndAt.Add(30 * time.Minute)
+	oldStartAt := moved.StartAt
+
+	changes := ReconcileRecords([]*TvRecord{moved, kept, canceled, unknown}, epgs, now)
+	assert.EqInt(2, len(changes), "ReconcileRecords should return 2 changes.")
+	assert.EqInt(int(RCMoved), int(changes[0].Type), "moved")
+	assert.Ok(changes[0].Record == moved, "moved")
+	assert.Ok(changes[0].OldStartAt.Equal(oldStartAt), "OldStartAt")
+	assert.Ok(moved.StartAt.Equal(epgs[0].StartAt), "StartAt should be updated.")
+	assert.Ok(moved.EndAt.Equal(epgs[0].EndAt), "EndAt should be updated.")
+	assert.EqInt(int(RCCanceled), int(changes[1].Type), "canceled")
+	assert.Ok(changes[1].Record == canceled, "canceled")
+
+	changes = ReconcileRecords([]*TvRecord{moved}, epgs, moved.EndAt)
+	assert.EqInt(0, len(changes), "Ended records should not be reconciled.")
+}
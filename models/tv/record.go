@@ -1,10 +1,13 @@
 package tv
 
 import (
+	"context"
 	"fmt"
 	"github.com/speedland/lib/util"
 	"github.com/speedland/wcg"
 	v "github.com/speedland/wcg/validation"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -14,6 +17,10 @@ var RecordValidator = v.NewObjectValidator()
 var InvalidChars = "[\x00-\x1F\x22-\x27\x2a-\x2c\x2f]"
 var ValidUUID = "^[a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12}$"
 
+// Global margins applied to records which do not define their own padding.
+var DefaultPrePadding = time.Duration(0)
+var DefaultPostPadding = time.Duration(0)
+
 type Record interface {
 	Key() string
 	Start() error
@@ -24,6 +31,18 @@ type Record interface {
 	CheckInterval() time.Duration
 }
 
+// PaddedRecord is implemented by a Record which defines its own margins
+// to start recording earlier and stop it later than StartAt/EndAt.
+type PaddedRecord interface {
+	Padding() (pre time.Duration, post time.Duration)
+}
+
+// TunerRecord is implemented by a Record which knows the tuner it uses.
+// Paddings are clipped so that records on the same tuner never overlap.
+type TunerRecord interface {
+	Tuner() string
+}
+
 type RecordState int
 
 var (
@@ -34,92 +53,262 @@ var (
 	RSFailed    = RecordState(5)
 )
 
+func (s RecordState) String() string {
+	switch s {
+	case RSWaiting:
+		return "waiting"
+	case RSRecording:
+		return "recording"
+	case RSCanceled:
+		return "canceled"
+	case RSSucceeded:
+		return "succeeded"
+	case RSFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// RestartPolicy configures how RecordCtrl retries to start a record
+// and restarts a recording process which has died.
+type RestartPolicy struct {
+	MaxRestarts int           // max number of (re)start attempts after a failure, negative for unlimited.
+	Backoff     time.Duration // delay after the first failure, doubled for each failure.
+	MaxBackoff  time.Duration // upper bound of the delay.
+	GiveUpAfter time.Duration // give up if the record could not start within this duration, 0 for never.
+}
+
+var DefaultRestartPolicy = &RestartPolicy{
+	MaxRestarts: 10,
+	Backoff:     time.Duration(5 * time.Second),
+	MaxBackoff:  time.Duration(1 * time.Minute),
+	GiveUpAfter: time.Duration(10 * time.Minute),
+}
+
+// Returns the delay before the n-th retry.
+func (p *RestartPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d = d * 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+func (p *RestartPolicy) exceeds(n int) bool {
+	return p.MaxRestarts >= 0 && n > p.MaxRestarts
+}
+
 type RecordCtrl struct {
-	record        Record
-	state         RecordState
-	stopCh        chan bool
-	logger        wcg.Logger
-	checkInterval time.Duration
+	record    Record
+	latest    Record // the latest definition of the record, which gives the time window.
+	state     RecordState
+	startAt   time.Time // StartAt with pre-roll padding
+	endAt     time.Time // EndAt with post-roll padding
+	policy    *RestartPolicy
+	storage   *StorageManager
+	output    *OutputManager
+	monitor   *HealthMonitor
+	health    health
+	failures  int       // number of failed attempts to start
+	restarts  int       // number of restarts after the process died
+	retryAt   time.Time // do not try to start before this time
+	err       error
+	reason    FailureReason
+	degraded  error // why the record is started in degraded mode
+	startedAt time.Time
+	endedAt   time.Time
+	logger    wcg.Logger
 }
 
 func NewRecordCtrl(rec Record) *RecordCtrl {
-	return &RecordCtrl{
+	ctrl := &RecordCtrl{
 		record: rec,
+		latest: rec,
 		state:  RSWaiting,
-		stopCh: make(chan bool, 1),
+		policy: DefaultRestartPolicy,
 		logger: util.GetLogger(),
 	}
+	ctrl.startAt, ctrl.endAt = paddedWindow(rec)
+	return ctrl
+}
+
+// Returns the recording window of the record including its padding.
+func paddedWindow(rec Record) (time.Time, time.Time) {
+	pre, post := DefaultPrePadding, DefaultPostPadding
+	if p, ok := rec.(PaddedRecord); ok {
+		pre, post = p.Padding()
+	}
+	if pre < 0 {
+		pre = 0
+	}
+	if post < 0 {
+		post = 0
+	}
+	return rec.StartAt().Add(-pre), rec.EndAt().Add(post)
+}
+
+func tunerOf(rec Record) string {
+	if t, ok := rec.(TunerRecord); ok {
+		return t.Tuner()
+	}
+	return ""
 }
 
 func (ctrl *RecordCtrl) String() string {
 	return fmt.Sprintf("[%v / %d]", ctrl.record, ctrl.state)
 }
 
-func (ctrl *RecordCtrl) Start() {
-	go func() {
-		ctrl.control()
-		c := time.Tick(ctrl.record.CheckInterval())
-		for {
-			select {
-			case <-ctrl.stopCh:
-				ctrl.record.Stop()
-				ctrl.state = RSCanceled
-				break
-			case <-c:
-				ctrl.control()
-				break
-				// default:
-				// 	ctrl.logger.Info("Controled %v", ctrl)
-				// 	break
-			}
-
-			if ctrl.state == RSSucceeded || ctrl.state == RSFailed || ctrl.state == RSCanceled {
-				break
-			}
-		}
-	}()
+func (ctrl *RecordCtrl) IsDone() bool {
+	return ctrl.state == RSSucceeded || ctrl.state == RSFailed || ctrl.state == RSCanceled
 }
 
+// Cancel stops the recording if it is running and marks the ctrl as canceled.
 func (ctrl *RecordCtrl) Cancel() {
-	ctrl.stopCh <- true
+	if ctrl.IsDone() {
+		return
+	}
+	if ctrl.state == RSRecording {
+		ctrl.record.Stop()
+		ctrl.updateSize()
+	}
+	ctrl.state = RSCanceled
+	ctrl.err = ErrCanceled
 }
 
-func (ctrl *RecordCtrl) control() {
-	now := time.Now()
+// Result returns the RecordResult for the current state.
+func (ctrl *RecordCtrl) Result() *RecordResult {
+	return &RecordResult{
+		Record:    ctrl.record,
+		State:     ctrl.state,
+		Reason:    ctrl.reason,
+		Err:       ctrl.err,
+		Restarts:  ctrl.restarts,
+		Stalls:    ctrl.health.stalls,
+		Degraded:  ctrl.degraded,
+		StartedAt: ctrl.startedAt,
+		EndedAt:   ctrl.endedAt,
+	}
+}
+
+// next returns the time when the ctrl should be controlled again.
+// The zero time is returned if it no longer needs to be controlled.
+func (ctrl *RecordCtrl) next(now time.Time) time.Time {
+	switch ctrl.state {
+	case RSWaiting:
+		if now.Before(ctrl.startAt) {
+			return ctrl.startAt
+		}
+		if ctrl.retryAt.After(now) {
+			return minTime(ctrl.retryAt, ctrl.endAt)
+		}
+		return minTime(now.Add(ctrl.record.CheckInterval()), ctrl.endAt)
+	case RSRecording:
+		// check the process periodically to restart it if it dies.
+		if ctrl.retryAt.After(now) {
+			return minTime(ctrl.retryAt, ctrl.endAt)
+		}
+		return minTime(now.Add(ctrl.record.CheckInterval()), ctrl.endAt)
+	default:
+		return time.Time{}
+	}
+}
+
+func (ctrl *RecordCtrl) control(now time.Time) {
 	record := ctrl.record
 	switch ctrl.state {
 	case RSWaiting:
-		if now.After(record.StartAt()) && now.Before(record.EndAt()) {
-			err := record.Start()
+		if !now.Before(ctrl.startAt) && now.Before(ctrl.endAt) {
+			if now.Before(ctrl.retryAt) {
+				break
+			}
+			var err error
+			if ctrl.storage != nil {
+				err = ctrl.storage.Check(record)
+				if _, ok := err.(*ErrDegraded); ok {
+					ctrl.logger.Warn("%v: %v", record, err)
+					ctrl.degraded = err
+					err = nil
+				}
+			}
+			if err == nil {
+				err = ctrl.startSegment()
+			}
 			if err == nil {
 				ctrl.state = RSRecording
+				ctrl.startedAt = now
 				ctrl.logger.Info("%v: Recording started.", record)
-			} else {
-				ctrl.logger.Error("%v: Could not start recording - %v", record, err)
+				break
 			}
-		} else if now.After(record.EndAt()) {
-			// invalid.
-			ctrl.state = RSCanceled
+			ctrl.failures += 1
+			ctrl.fail(err)
+			ctrl.logger.Error("%v: Could not start recording (%d) - %v", record, ctrl.failures, err)
+			if ctrl.reason.IsFatal() || ctrl.policy.exceeds(ctrl.failures) ||
+				(ctrl.policy.GiveUpAfter > 0 && now.Sub(ctrl.startAt) >= ctrl.policy.GiveUpAfter) {
+				ctrl.logger.Error("%v: Gave up recording (%s).", record, ctrl.reason)
+				ctrl.finish(RSFailed, now)
+				break
+			}
+			ctrl.retryAt = now.Add(ctrl.policy.delay(ctrl.failures))
+		} else if !now.Before(ctrl.endAt) {
+			// the record has never been started.
+			if ctrl.err == nil {
+				ctrl.fail(&ErrRecordFailed{Reason: FRNotStarted})
+			}
+			ctrl.logger.Warn("%v: Recording has never been started, marked as failure.", record)
+			ctrl.finish(RSFailed, now)
 		}
 		break
 	case RSRecording:
-		if now.After(record.StartAt()) && now.Before(record.EndAt()) {
-			if !record.IsRunning() {
-				err := record.Start()
-				if err == nil {
-					ctrl.logger.Info("%v: Recording restarted.", record)
-				} else {
-					ctrl.logger.Error("%v: Could not restart recording - %v", record, err)
+		if !now.Before(ctrl.startAt) && now.Before(ctrl.endAt) {
+			if record.IsRunning() {
+				if ctrl.monitor != nil && ctrl.monitor.check(ctrl, now) && ctrl.monitor.RestartOnStall {
+					ctrl.logger.Warn("%v: Stopping the stalled recording to restart it.", record)
+					record.Stop()
+					ctrl.fail(&ErrRecordFailed{Reason: FRSignalLost, Err: ErrStalled})
 				}
+				break
 			}
-		} else if now.After(record.EndAt()) {
+			if now.Before(ctrl.retryAt) {
+				break
+			}
+			if ctrl.policy.exceeds(ctrl.restarts + 1) {
+				if ctrl.err == nil {
+					ctrl.fail(fmt.Errorf("Recording process died %d times", ctrl.restarts+1))
+				}
+				ctrl.logger.Error("%v: Gave up restarting recording (%s).", record, ctrl.reason)
+				ctrl.finish(RSFailed, now)
+				break
+			}
+			ctrl.restarts += 1
+			err := ctrl.startSegment()
+			if err == nil {
+				// the output is monitored from the restart.
+				ctrl.health.lastAt = time.Time{}
+				ctrl.logger.Info("%v: Recording restarted (%d).", record, ctrl.restarts)
+				break
+			}
+			ctrl.fail(err)
+			ctrl.logger.Error("%v: Could not restart recording (%d) - %v", record, ctrl.restarts, err)
+			if ctrl.reason.IsFatal() {
+				ctrl.finish(RSFailed, now)
+				break
+			}
+			ctrl.retryAt = now.Add(ctrl.policy.delay(ctrl.restarts))
+		} else if !now.Before(ctrl.endAt) {
 			if record.IsRunning() {
 				ctrl.record.Stop()
-				ctrl.state = RSSucceeded
+				ctrl.finish(RSSucceeded, now)
 				ctrl.logger.Info("%v: Recording stopped.", record)
 			} else {
 				ctrl.logger.Warn("%v: Recording is not running, marked as failure.", record)
-				ctrl.state = RSFailed
+				if ctrl.err == nil {
+					ctrl.fail(fmt.Errorf("Recording process is not running at the end"))
+				}
+				ctrl.finish(RSFailed, now)
 			}
 		}
 		break
@@ -129,21 +318,94 @@ func (ctrl *RecordCtrl) control() {
 	}
 }
 
+// startSegment starts the record with a new output segment so that the
+// output of the previous run is not overwritten.
+func (ctrl *RecordCtrl) startSegment() error {
+	provider, ok := ctrl.record.(TvRecordProvider)
+	if ctrl.output == nil || !ok {
+		return ctrl.record.Start()
+	}
+	rec := provider.GetTvRecord()
+	p, err := ctrl.output.NextSegment(rec)
+	if err != nil {
+		return err
+	}
+	if err = ctrl.record.Start(); err != nil {
+		ctrl.output.discardSegment(rec, p)
+	}
+	return err
+}
+
+func (ctrl *RecordCtrl) fail(err error) {
+	ctrl.err = err
+	ctrl.reason = ClassifyFailure(err)
+}
+
+func (ctrl *RecordCtrl) finish(state RecordState, now time.Time) {
+	ctrl.state = state
+	ctrl.endedAt = now
+	ctrl.updateSize()
+}
+
+func (ctrl *RecordCtrl) updateSize() {
+	if provider, ok := ctrl.record.(TvRecordProvider); ok && ctrl.output != nil {
+		if err := ctrl.output.UpdateSize(provider.GetTvRecord()); err != nil {
+			ctrl.logger.Warn("%v: Could not update the output size - %v", ctrl.record, err)
+		}
+	}
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// RecordResult is a final result of a record notified to the listeners
+// registered by Recorder.OnResult.
 type RecordResult struct {
-	record Record
-	err    error
+	Record    Record
+	State     RecordState
+	Reason    FailureReason // only for RSFailed
+	Err       error         // nil for RSSucceeded
+	Restarts  int
+	Stalls    int   // number of times the output got stalled
+	Degraded  error // non-nil if the record was started in degraded mode
+	StartedAt time.Time
+	EndedAt   time.Time
 }
 
 var ErrCanceled = fmt.Errorf("Canceled")
 
 // Recorder is a control component to manage all recorder objects.
+// All records are controlled by a single goroutine which sleeps until
+// the earliest deadline of the records.
 type Recorder struct {
-	receiver   <-chan []Record
-	recorder   chan *RecordResult
-	controls   map[string]*RecordCtrl
-	iSec       int
-	shouldStop bool
-	logger     wcg.Logger
+	// Clock used to schedule records, which should be set before Start.
+	Clock Clock
+	// RestartPolicy applied to the records given after it is set.
+	RestartPolicy *RestartPolicy
+	// Storage checks the free space before starting records if set.
+	Storage *StorageManager
+	// Output allocates a new output segment of TvRecordProviders on every
+	// (re)start if set.
+	Output *OutputManager
+	// Monitor checks the output growth of the records if set.
+	Monitor *HealthMonitor
+
+	receiver  <-chan []Record
+	listeners []func(*RecordResult)
+	controls  map[string]*RecordCtrl
+	scheduler *scheduler
+	stopCh    chan bool
+	wakeCh    chan bool
+	doneCh    chan bool
+	idleCh    chan bool // closed when no recordings are in progress during the shutdown
+	running   bool
+	draining  bool
+	mutex     sync.RWMutex
+	logger    wcg.Logger
 	// stats
 	waiting   int
 	recording int
@@ -152,40 +414,254 @@ type Recorder struct {
 	failed    int
 }
 
+var ErrShutdown = fmt.Errorf("Recorder is shut down")
+
 // Create a new Recorder instance.
 // receiver should be a channel to register the record
 func NewRecorder(receiver <-chan []Record) *Recorder {
 	return &Recorder{
-		receiver:   receiver,
-		recorder:   make(chan *RecordResult, 128),
-		controls:   make(map[string]*RecordCtrl),
-		shouldStop: false,
-		logger:     util.GetLogger(),
+		Clock:         SystemClock,
+		RestartPolicy: DefaultRestartPolicy,
+		receiver:      receiver,
+		listeners:     make([]func(*RecordResult), 0),
+		controls:      make(map[string]*RecordCtrl),
+		scheduler:     newScheduler(SystemClock),
+		stopCh:        make(chan bool, 1),
+		wakeCh:        make(chan bool, 1),
+		logger:        util.GetLogger(),
 	}
 }
 
+// Start runs the control loop until Stop is called.
+//
+// Deprecated: use Run. The interval is ignored since the loop sleeps until
+// the next deadline of the records instead of polling.
 func (r *Recorder) Start(interval time.Duration) {
-	c := time.Tick(interval)
-	for !r.shouldStop {
+	r.Run()
+}
+
+// Run runs the control loop until Stop is called.
+// It can be run again after the loop is stopped.
+func (r *Recorder) Run() {
+	r.mutex.Lock()
+	if r.running {
+		r.mutex.Unlock()
+		return
+	}
+	r.running = true
+	r.doneCh = make(chan bool)
+	r.scheduler.clock = r.Clock
+	r.scheduler.reset()
+	done := r.doneCh
+	r.mutex.Unlock()
+	// discard Stop called while the loop was not running.
+	select {
+	case <-r.stopCh:
+	default:
+	}
+	defer func() {
+		r.mutex.Lock()
+		r.running = false
+		if r.idleCh != nil {
+			close(r.idleCh)
+			r.idleCh = nil
+		}
+		r.mutex.Unlock()
+		close(done)
+	}()
+	for {
+		r.mutex.RLock()
+		timer := r.scheduler.C()
+		r.mutex.RUnlock()
+		stopped := false
 		select {
 		case records := <-r.receiver:
+			r.mutex.Lock()
 			r.merge(records)
+			r.mutex.Unlock()
+			break
+		case <-timer:
+			r.mutex.Lock()
+			r.fire()
+			r.mutex.Unlock()
 			break
-		case <-c:
+		case <-r.wakeCh:
 			break
+		case <-r.stopCh:
+			stopped = true
+			break
+		}
+		r.mutex.Lock()
+		results := r.updateStats()
+		listeners := r.listeners
+		if r.idleCh != nil && r.recording == 0 {
+			close(r.idleCh)
+			r.idleCh = nil
+		}
+		r.mutex.Unlock()
+		for _, result := range results {
+			for _, f := range listeners {
+				f(result)
+			}
+		}
+		if stopped {
+			return
 		}
-		r.updateStats()
 	}
 }
 
+// OnResult registers a listener called with the result of each record
+// when it gets succeeded, failed or canceled. Listeners are called from
+// the control loop so they should not block.
+func (r *Recorder) OnResult(f func(*RecordResult)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners = append(r.listeners, f)
+}
+
+// Stop stops the control loop immediately. The recording processes are
+// left as they are, use Shutdown to finish them.
 func (r *Recorder) Stop() {
-	r.shouldStop = true
+	select {
+	case r.stopCh <- true:
+	default:
+	}
+}
+
+// Drain puts the recorder into the maintenance mode where new records are
+// not accepted and waiting records are not started. Recordings which have
+// already started continue until their end.
+func (r *Recorder) Drain() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.draining {
+		return
+	}
+	r.logger.Info("Recorder gets into drain mode.")
+	r.draining = true
+	for _, ctrl := range r.controls {
+		if ctrl.state == RSWaiting {
+			r.scheduler.Remove(ctrl)
+		}
+	}
+	r.wake()
+}
+
+// Resume gets the recorder back from the drain mode. New records are
+// accepted from the next update of the receiver.
+func (r *Recorder) Resume() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.draining {
+		return
+	}
+	r.logger.Info("Recorder resumes from drain mode.")
+	r.draining = false
+	for _, ctrl := range r.controls {
+		if ctrl.state == RSWaiting {
+			r.scheduler.Schedule(ctrl, ctrl.startAt)
+		}
+	}
+	r.wake()
+}
+
+func (r *Recorder) IsDraining() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.draining
+}
+
+// Shutdown stops accepting new records, cancels the waiting ones and waits
+// for the recordings in progress to finish. If ctx is done before that, the
+// recordings are stopped so that their output is finalized, and ctx.Err()
+// is returned. Pass a canceled context to stop them without waiting.
+// The control loop is stopped after all recordings are finished.
+func (r *Recorder) Shutdown(ctx context.Context) error {
+	r.mutex.RLock()
+	running := r.running
+	r.mutex.RUnlock()
+	if !running {
+		return nil
+	}
+	r.Drain()
+	r.mutex.Lock()
+	if !r.running {
+		r.mutex.Unlock()
+		return nil
+	}
+	done := r.doneCh
+	for _, ctrl := range r.controls {
+		if ctrl.state == RSWaiting {
+			ctrl.Cancel()
+			ctrl.err = ErrShutdown
+		}
+	}
+	idle := make(chan bool)
+	r.idleCh = idle
+	r.wake()
+	r.mutex.Unlock()
+
+	var err error
+	select {
+	case <-idle:
+		break
+	case <-ctx.Done():
+		err = ctx.Err()
+		r.mutex.Lock()
+		now := r.Clock.Now()
+		for _, ctrl := range r.controls {
+			if ctrl.state == RSRecording {
+				r.logger.Info("%v: Stopping the recording for shutdown.", ctrl.record)
+				ctrl.Cancel()
+				ctrl.err = ErrShutdown
+				ctrl.endedAt = now
+				r.scheduler.Remove(ctrl)
+			}
+		}
+		r.mutex.Unlock()
+	}
+	r.Stop()
+	<-done
+	r.logger.Info("Recorder is shut down.")
+	return err
+}
+
+// wake lets the control loop re-evaluate the scheduler after it is updated
+// outside of the loop.
+func (r *Recorder) wake() {
+	select {
+	case r.wakeCh <- true:
+	default:
+	}
+}
+
+// fire controls all records whose deadlines have come.
+func (r *Recorder) fire() {
+	now := r.Clock.Now()
+	for _, ctrl := range r.scheduler.Due(now) {
+		if r.draining && ctrl.state == RSWaiting {
+			// held until Resume.
+			continue
+		}
+		ctrl.control(now)
+		r.schedule(ctrl, now)
+	}
+}
+
+func (r *Recorder) schedule(ctrl *RecordCtrl, now time.Time) {
+	if next := ctrl.next(now); next.IsZero() {
+		r.scheduler.Remove(ctrl)
+	} else {
+		r.scheduler.Schedule(ctrl, next)
+	}
 }
 
 func (r *Recorder) Upcomming() time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	var min time.Time
 	for _, v := range r.controls {
-		t := v.record.StartAt()
+		t := v.startAt
 		if v.state == RSWaiting || v.state == RSRecording {
 			if min.IsZero() {
 				min = t
@@ -201,7 +677,7 @@ func (r *Recorder) Upcomming() time.Time {
 
 func (r *Recorder) merge(newrecords []Record) {
 	// convert newrecords to map
-	now := time.Now()
+	now := r.Clock.Now()
 	newmap := make(map[string]Record)
 	for _, rec := range newrecords {
 		if rec.EndAt().After(now) {
@@ -213,28 +689,87 @@ func (r *Recorder) merge(newrecords []Record) {
 		r.logger.Trace("Check %d record(s) under controls.", len(r.controls))
 		for key, ctrl := range r.controls {
 			r.logger.Trace("Check %s key in controls.", key)
-			if _, ok := newmap[key]; ok {
-				r.logger.Debug("%s already exists, skipping.", key)
+			if rec, ok := newmap[key]; ok {
+				if !rec.StartAt().Equal(ctrl.latest.StartAt()) || !rec.EndAt().Equal(ctrl.latest.EndAt()) || !sameRecord(rec, ctrl.latest) {
+					r.logger.Info("%s has been updated to %v - %v.", key, rec.StartAt(), rec.EndAt())
+					ctrl.latest = rec
+					if ctrl.state == RSWaiting {
+						ctrl.record = rec
+					}
+				} else {
+					r.logger.Debug("%s already exists, skipping.", key)
+				}
 				delete(newmap, key)
 			} else {
 				// no longer exists so cancel.
 				r.logger.Debug("%s is no longer exists, canceled.", key)
 				ctrl.Cancel()
+				r.scheduler.Remove(ctrl)
 			}
 		}
 	}
 
-	if len(newmap) > 0 {
+	if len(newmap) > 0 && r.draining {
+		r.logger.Info("New %d record(s) are ignored in drain mode.", len(newmap))
+	} else if len(newmap) > 0 {
 		r.logger.Info("New %d record(s) gets under controls.", len(newmap))
 		for key, rec := range newmap {
 			ctrl := NewRecordCtrl(rec)
-			ctrl.Start()
+			ctrl.policy = r.RestartPolicy
+			ctrl.storage = r.Storage
+			ctrl.output = r.Output
+			ctrl.monitor = r.Monitor
 			r.controls[key] = ctrl
 		}
 	}
+	// paddings of existing records may be clipped by new ones.
+	r.clipPaddings()
+	for _, ctrl := range r.controls {
+		if ctrl.state != RSWaiting {
+			r.schedule(ctrl, now)
+		} else if !r.draining {
+			r.scheduler.Schedule(ctrl, ctrl.startAt)
+		}
+	}
 }
 
-func (r *Recorder) updateStats() {
+// sameRecord returns false if b is another object than a, which means the
+// definition of the record is updated (e.g. the channel is changed).
+func sameRecord(a Record, b Record) bool {
+	if !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return true
+	}
+	return a == b
+}
+
+// clipPaddings updates the padded windows of the records and shrinks them
+// so that padding never extends into the original time slot of another
+// record on the same tuner.
+func (r *Recorder) clipPaddings() {
+	for _, ctrl := range r.controls {
+		startAt, endAt := paddedWindow(ctrl.latest)
+		tuner := tunerOf(ctrl.latest)
+		if tuner == "" {
+			ctrl.startAt, ctrl.endAt = startAt, endAt
+			continue
+		}
+		for _, other := range r.controls {
+			if other == ctrl || tunerOf(other.latest) != tuner {
+				continue
+			}
+			if !other.latest.EndAt().After(ctrl.latest.StartAt()) && startAt.Before(other.latest.EndAt()) {
+				startAt = other.latest.EndAt()
+			}
+			if !ctrl.latest.EndAt().After(other.latest.StartAt()) && endAt.After(other.latest.StartAt()) {
+				endAt = other.latest.StartAt()
+			}
+		}
+		ctrl.startAt, ctrl.endAt = startAt, endAt
+	}
+}
+
+// updateStats removes finished records from the controls and returns their results.
+func (r *Recorder) updateStats() []*RecordResult {
 	removals := make([]string, 0)
 	var waiting, recording, succeeded, canceled, failed int
 	for key, rctrl := range r.controls {
@@ -257,7 +792,9 @@ func (r *Recorder) updateStats() {
 			break
 		}
 	}
+	results := make([]*RecordResult, 0, len(removals))
 	for _, key := range removals {
+		results = append(results, r.controls[key].Result())
 		delete(r.controls, key)
 	}
 	r.waiting = waiting
@@ -265,6 +802,7 @@ func (r *Recorder) updateStats() {
 	r.succeeded = r.succeeded + succeeded
 	r.failed = r.failed + failed
 	r.canceled = r.canceled + canceled
+	return results
 }
 
 type TvRecord struct {
@@ -280,8 +818,20 @@ type TvRecord struct {
 	InputIdx  int       `json:"input_idx"`  // PT2 input channel index
 	EventId   int       `json:"event_id"`   // EPG Event ID
 	IEpgId    string    `json:"iepg_id"`    // IEPG ID
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	RuleId    string    `json:"rule_id"`    // ID of the rule which generated the record
+	// Padding in seconds, 0 uses DefaultPrePadding/DefaultPostPadding
+	// and a negative value disables the padding.
+	PrePadding  int      `json:"pre_padding"`
+	PostPadding int      `json:"post_padding"`
+	Files       []string `json:"files"` // Output files, more than one if the recording is restarted.
+	Size        int64    `json:"size"`  // Total bytes of Files
+	// Results of the post processing
+	PostProcess []*PostProcessStatus `json:"post_process"`
+	Checksums   map[string]string    `json:"checksums"`      // SHA-256 keyed by file name
+	Artifacts   map[string][]string  `json:"artifacts"`      // Files generated by CommandSteps
+	Meta        *ProgramMeta         `json:"meta,omitempty"` // Metadata of the program
+	CreatedAt   time.Time            `json:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at"`
 }
 
 func NewTvRecord(title string, category string, start time.Time, end time.Time,
@@ -310,10 +860,43 @@ func (r *TvRecord) String() string {
 	return "Record:" + r.Key()
 }
 
+func (r *TvRecord) Padding() (time.Duration, time.Duration) {
+	return paddingSeconds(r.PrePadding, DefaultPrePadding),
+		paddingSeconds(r.PostPadding, DefaultPostPadding)
+}
+
+func (r *TvRecord) Channel() string {
+	return r.Cid
+}
+
+// Use InputIdx as a tuner so that paddings are clipped per PT2 input.
+func (r *TvRecord) Tuner() string {
+	return fmt.Sprintf("%d", r.InputIdx)
+}
+
+func paddingSeconds(sec int, def time.Duration) time.Duration {
+	if sec == 0 {
+		return def
+	}
+	if sec < 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
 func (r *TvRecord) RecordTime() time.Duration {
 	return r.EndAt.Sub(r.StartAt)
 }
 
+// CurrentFile returns the output file of the current segment, or "" if no
+// segments are allocated.
+func (r *TvRecord) CurrentFile() string {
+	if len(r.Files) == 0 {
+		return ""
+	}
+	return r.Files[len(r.Files)-1]
+}
+
 func init() {
 	RecordValidator.Field("Id").Required().Match(ValidUUID)
 	RecordValidator.Field("Title").Required().
@@ -1,9 +1,13 @@
 package tv
 
 import (
+	"context"
 	"fmt"
 	"github.com/speedland/lib/util"
 	"github.com/speedland/wcg"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -15,6 +19,7 @@ type DummyRecord struct {
 	stopCh    chan bool
 	done      bool
 	isRunning bool
+	mutex     sync.Mutex
 }
 
 func NewDummyRecord(key string) *DummyRecord {
@@ -41,15 +46,27 @@ func (dr *DummyRecord) String() string {
 }
 
 func (dr *DummyRecord) IsRunning() bool {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
 	return dr.isRunning
 }
 
+func (dr *DummyRecord) IsDone() bool {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	return dr.done
+}
+
 func (dr *DummyRecord) Start() error {
+	dr.mutex.Lock()
 	dr.isRunning = true
+	dr.mutex.Unlock()
 	go func() {
 		<-dr.stopCh
+		dr.mutex.Lock()
 		dr.isRunning = false
 		dr.done = true
+		dr.mutex.Unlock()
 	}()
 	return nil
 }
@@ -63,27 +80,69 @@ func (dr *DummyRecord) CheckInterval() time.Duration {
 	return time.Duration(1 * time.Millisecond)
 }
 
-func TestRecorderUpcomming(t *testing.T) {
-	assert := wcg.NewAssert(t)
+func newTestRecorder() (*Recorder, chan []Record, *FakeClock) {
 	receiver := make(chan []Record)
 	recorder := NewRecorder((<-chan []Record)(receiver))
-	interval := time.Duration(30) * time.Millisecond
+	clock := NewFakeClock(time.Now())
+	recorder.Clock = clock
+	go recorder.Run()
+	receiver <- []Record{} // returns after the loop has started.
+	return recorder, receiver, clock
+}
+
+func numControls(r *Recorder) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.controls)
+}
+
+func numSucceeded(r *Recorder) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.succeeded
+}
+
+// notifyContext tells when Done is called, i.e. Shutdown starts waiting.
+type notifyContext struct {
+	context.Context
+	waiting chan bool
+}
+
+func (ctx *notifyContext) Done() <-chan struct{} {
+	select {
+	case ctx.waiting <- true:
+	default:
+	}
+	return ctx.Context.Done()
+}
+
+func stateOf(r *Recorder, key string) RecordState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if ctrl, ok := r.controls[key]; ok {
+		return ctrl.state
+	}
+	return RecordState(0)
+}
+
+func TestRecorderUpcomming(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, clock := newTestRecorder()
 	wait := 10
-	go recorder.Start(interval)
 
 	r1 := NewDummyRecord("r1")
-	r1.startAt = time.Now().Add(time.Duration(2 * time.Hour))
+	r1.startAt = clock.Now().Add(time.Duration(2 * time.Hour))
 	r1.endAt = r1.startAt.Add(time.Duration(10 * time.Minute))
 	r2 := NewDummyRecord("r2")
-	r2.startAt = time.Now().Add(time.Duration(4 * time.Hour))
+	r2.startAt = clock.Now().Add(time.Duration(4 * time.Hour))
 	r2.endAt = r2.startAt.Add(time.Duration(10 * time.Minute))
 	r3 := NewDummyRecord("r3")
-	r3.startAt = time.Now().Add(time.Duration(8 * time.Hour))
+	r3.startAt = clock.Now().Add(time.Duration(8 * time.Hour))
 	r3.endAt = r3.startAt.Add(time.Duration(10 * time.Minute))
 
 	receiver <- []Record{r1, r2, r3}
 	err := util.WaitFor(func() bool {
-		return len(recorder.controls) == 3
+		return numControls(recorder) == 3
 	}, wait)
 	assert.Nil(err, "check all records in controls.")
 
@@ -94,59 +153,55 @@ func TestRecorderUpcomming(t *testing.T) {
 
 func TestRecorderStart(t *testing.T) {
 	assert := wcg.NewAssert(t)
-	receiver := make(chan []Record)
-	recorder := NewRecorder((<-chan []Record)(receiver))
-
-	interval := time.Duration(30) * time.Millisecond
+	recorder, receiver, clock := newTestRecorder()
 	wait := 10
-	go recorder.Start(interval)
 
-	now := time.Now()
-	r1 := NewDummyRecord("r1") // cancel before starting
-	r1.startAt = now
-	r1.endAt = now.Add(time.Duration(5 * time.Second))
+	now := clock.Now()
+	r1 := NewDummyRecord("r1")
+	r1.startAt = now.Add(time.Duration(1 * time.Minute))
+	r1.endAt = now.Add(time.Duration(31 * time.Minute))
 	receiver <- []Record{r1}
 	err := util.WaitFor(func() bool {
-		return len(recorder.controls) == 1
+		return numControls(recorder) == 1
 	}, wait)
 	assert.Nil(err, "check r1 in controls.")
-	ctrl := recorder.controls[r1.Key()]
+	assert.EqInt(int(RSWaiting), int(stateOf(recorder, r1.Key())), "Record state should be RSWaiting")
+
+	clock.Advance(time.Duration(1 * time.Minute))
+	err = util.WaitFor(func() bool {
+		return stateOf(recorder, r1.Key()) == RSRecording
+	}, wait)
+	assert.Nil(err, "check r1 in RSRecording state.")
 
+	clock.Advance(time.Duration(30 * time.Minute))
 	err = util.WaitFor(func() bool {
-		return r1.done == true
+		return r1.IsDone()
 	}, wait)
 	assert.Nil(err, "check r1 has been done.")
-	assert.EqInt(int(RSSucceeded), int(ctrl.state), "Record state should be RSSucceeded")
+	assert.EqInt(1, numSucceeded(recorder), "r1 should be succeeded")
 	recorder.Stop()
 }
 
 func TestRecorderStart_CancelBeforeStart(t *testing.T) {
 	assert := wcg.NewAssert(t)
-	receiver := make(chan []Record)
-	recorder := NewRecorder((<-chan []Record)(receiver))
-
-	interval := time.Duration(30) * time.Millisecond
+	recorder, receiver, clock := newTestRecorder()
 	wait := 10
-	go recorder.Start(interval)
 
-	now := time.Now()
+	now := clock.Now()
 	r1 := NewDummyRecord("r1") // cancel before starting
 	r1.startAt = now.Add(time.Duration(30 * time.Minute))
 	r1.endAt = now.Add(time.Duration(60 * time.Minute))
-	// r2 := NewDummyRecord("r2") // cancel after starting
-	// r3 := NewDummyRecord("r3") // succeeded
-	// r4 := NewDummyRecord("r4") // failed
 
 	receiver <- []Record{r1}
 	err := util.WaitFor(func() bool {
-		return len(recorder.controls) == 1
+		return numControls(recorder) == 1
 	}, wait)
 	assert.Nil(err, "check r1 in controls.")
-	assert.EqStr(r1.Key(), recorder.controls[r1.Key()].record.Key(), "check r1 in controls.")
+	assert.EqInt(int(RSWaiting), int(stateOf(recorder, r1.Key())), "check r1 in controls.")
 
 	receiver <- []Record{}
 	err = util.WaitFor(func() bool {
-		return len(recorder.controls) == 0
+		return numControls(recorder) == 0
 	}, wait)
 	assert.Nil(err, "check r1 removed from controls.")
 
@@ -155,35 +210,29 @@ func TestRecorderStart_CancelBeforeStart(t *testing.T) {
 
 func TestRecorderStart_CancelWhileRecording(t *testing.T) {
 	assert := wcg.NewAssert(t)
-	receiver := make(chan []Record)
-	recorder := NewRecorder((<-chan []Record)(receiver))
-	interval := time.Duration(30) * time.Millisecond
+	recorder, receiver, clock := newTestRecorder()
 	wait := 5
 
-	go recorder.Start(interval)
-
-	now := time.Now()
-	r1 := NewDummyRecord("r1") // cancel before starting
+	now := clock.Now()
+	r1 := NewDummyRecord("r1") // cancel after starting
 	r1.startAt = now
 	r1.endAt = now.Add(time.Duration(30 * time.Minute))
 
 	receiver <- []Record{r1}
 	err := util.WaitFor(func() bool {
-		return len(recorder.controls) == 1
-	}, wait)
-	assert.Nil(err, "check r1 in controls.")
-	assert.EqStr(r1.Key(), recorder.controls[r1.Key()].record.Key(), "check r1 in controls.")
-
-	err = util.WaitFor(func() bool {
-		return recorder.controls[r1.Key()].state == RSRecording
+		return stateOf(recorder, r1.Key()) == RSRecording
 	}, wait)
 	assert.Nil(err, "check r1 in RSRecording state.")
 
 	receiver <- []Record{}
 	err = util.WaitFor(func() bool {
-		return len(recorder.controls) == 0
+		return numControls(recorder) == 0
 	}, wait)
 	assert.Nil(err, "check r1 removed from controls.")
+	err = util.WaitFor(func() bool {
+		return r1.IsDone()
+	}, wait)
+	assert.Nil(err, "check r1 has been stopped.")
 
 	recorder.Stop()
 }
@@ -223,3 +272,354 @@ func TestRecordValidator(t *testing.T) {
 	err = RecordValidator.Eval(r)
 	assert.Nil(err, "日本語 特殊文字 Valiation")
 }
+
+type PaddedDummyRecord struct {
+	*DummyRecord
+	pre   time.Duration
+	post  time.Duration
+	tuner string
+}
+
+func (dr *PaddedDummyRecord) Padding() (time.Duration, time.Duration) {
+	return dr.pre, dr.post
+}
+
+func (dr *PaddedDummyRecord) Tuner() string {
+	return dr.tuner
+}
+
+func NewPaddedDummyRecord(key string, start time.Time, end time.Time, tuner string) *PaddedDummyRecord {
+	dr := NewDummyRecord(key)
+	dr.startAt = start
+	dr.endAt = end
+	return &PaddedDummyRecord{
+		DummyRecord: dr,
+		pre:         time.Duration(1 * time.Minute),
+		post:        time.Duration(2 * time.Minute),
+		tuner:       tuner,
+	}
+}
+
+func TestRecorderPadding(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder := NewRecorder(make(chan []Record))
+
+	base := time.Now().Add(time.Duration(2 * time.Hour))
+	r1 := NewPaddedDummyRecord("r1", base, base.Add(30*time.Minute), "0")
+	r2 := NewPaddedDummyRecord("r2", base.Add(30*time.Minute), base.Add(60*time.Minute), "0")
+	r3 := NewPaddedDummyRecord("r3", base.Add(30*time.Minute), base.Add(60*time.Minute), "1")
+	recorder.merge([]Record{r1, r2, r3})
+
+	c1 := recorder.controls["r1"]
+	c2 := recorder.controls["r2"]
+	c3 := recorder.controls["r3"]
+	assert.Ok(c1.startAt.Equal(base.Add(-1*time.Minute)), "r1 should start 1 minute earlier.")
+	assert.Ok(c1.endAt.Equal(r2.startAt), "r1 post padding should be clipped by r2.")
+	assert.Ok(c2.startAt.Equal(r1.endAt), "r2 pre padding should be clipped by r1.")
+	assert.Ok(c2.endAt.Equal(r2.endAt.Add(2*time.Minute)), "r2 should end 2 minutes later.")
+	assert.Ok(c3.startAt.Equal(r3.startAt.Add(-1*time.Minute)), "r3 on the other tuner should not be clipped.")
+	assert.Ok(c3.endAt.Equal(r3.endAt.Add(2*time.Minute)), "r3 on the other tuner should not be clipped.")
+}
+
+func TestTvRecordPadding(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	r := genTestRecord()
+	DefaultPrePadding = 10 * time.Second
+	defer func() { DefaultPrePadding = 0 }()
+
+	pre, post := r.Padding()
+	assert.Ok(pre == 10*time.Second, "PrePadding should be DefaultPrePadding.")
+	assert.Ok(post == 0, "PostPadding should be DefaultPostPadding.")
+
+	r.PrePadding = -1
+	r.PostPadding = 30
+	pre, post = r.Padding()
+	assert.Ok(pre == 0, "Negative PrePadding should disable the padding.")
+	assert.Ok(post == 30*time.Second, "PostPadding should be taken from the record.")
+}
+
+func TestScheduler(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	clock := NewFakeClock(time.Now())
+	s := newScheduler(clock)
+	now := clock.Now()
+	c1 := NewRecordCtrl(NewDummyRecord("c1"))
+	c2 := NewRecordCtrl(NewDummyRecord("c2"))
+	c3 := NewRecordCtrl(NewDummyRecord("c3"))
+	s.Schedule(c1, now.Add(3*time.Minute))
+	s.Schedule(c2, now.Add(1*time.Minute))
+	s.Schedule(c3, now.Add(2*time.Minute))
+	s.Schedule(c1, now.Add(30*time.Second))
+	s.Remove(c3)
+	assert.EqInt(2, s.Len(), "scheduler should have 2 ctrls.")
+
+	clock.Advance(30 * time.Second)
+	<-s.C()
+	due := s.Due(clock.Now())
+	assert.EqInt(1, len(due), "1 ctrl should be due.")
+	assert.Ok(due[0] == c1, "c1 should be due first.")
+
+	clock.Advance(30 * time.Second)
+	<-s.C()
+	due = s.Due(clock.Now())
+	assert.EqInt(1, len(due), "1 ctrl should be due.")
+	assert.Ok(due[0] == c2, "c2 should be due next.")
+	assert.Ok(s.C() == nil, "timer should not be armed when nothing is scheduled.")
+}
+
+type FailingRecord struct {
+	*DummyRecord
+	errors []error
+}
+
+func (fr *FailingRecord) Start() error {
+	if len(fr.errors) > 0 {
+		err := fr.errors[0]
+		fr.errors = fr.errors[1:]
+		return err
+	}
+	return fr.DummyRecord.Start()
+}
+
+func TestRecorderStart_RetryWithBackoff(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, clock := newTestRecorder()
+	wait := 5
+
+	results := make(chan *RecordResult, 1)
+	recorder.OnResult(func(r *RecordResult) {
+		results <- r
+	})
+	now := clock.Now()
+	r1 := &FailingRecord{
+		DummyRecord: NewDummyRecord("r1"),
+		errors:      []error{fmt.Errorf("Cannot tune to the specified channel")},
+	}
+	r1.startAt = now
+	r1.endAt = now.Add(time.Duration(30 * time.Minute))
+	receiver <- []Record{r1}
+	err := util.WaitFor(func() bool {
+		return numControls(recorder) == 1
+	}, wait)
+	assert.Nil(err, "check r1 in controls.")
+	assert.EqInt(int(RSWaiting), int(stateOf(recorder, r1.Key())), "r1 should wait for the backoff.")
+
+	clock.Advance(DefaultRestartPolicy.Backoff)
+	err = util.WaitFor(func() bool {
+		return stateOf(recorder, r1.Key()) == RSRecording
+	}, wait)
+	assert.Nil(err, "r1 should be started after the backoff.")
+
+	clock.Advance(time.Duration(30 * time.Minute))
+	result := <-results
+	assert.EqInt(int(RSSucceeded), int(result.State), "r1 should be succeeded.")
+	recorder.Stop()
+}
+
+func TestRecorderStart_GiveUp(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, clock := newTestRecorder()
+
+	results := make(chan *RecordResult, 1)
+	recorder.OnResult(func(r *RecordResult) {
+		results <- r
+	})
+	now := clock.Now()
+	r1 := &FailingRecord{
+		DummyRecord: NewDummyRecord("r1"),
+		errors:      []error{fmt.Errorf("/dev/pt1video0: No such file or directory")},
+	}
+	r1.startAt = now
+	r1.endAt = now.Add(time.Duration(30 * time.Minute))
+	receiver <- []Record{r1}
+	result := <-results
+	assert.EqInt(int(RSFailed), int(result.State), "r1 should be failed.")
+	assert.EqInt(int(FRDeviceMissing), int(result.Reason), "r1 should be failed by the missing device.")
+	assert.NotNil(result.Err, "result should have the error.")
+	recorder.Stop()
+}
+
+func TestRestartPolicyDelay(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	p := &RestartPolicy{
+		MaxRestarts: 3,
+		Backoff:     time.Duration(5 * time.Second),
+		MaxBackoff:  time.Duration(15 * time.Second),
+	}
+	assert.Ok(p.delay(1) == 5*time.Second, "1st delay")
+	assert.Ok(p.delay(2) == 10*time.Second, "2nd delay")
+	assert.Ok(p.delay(3) == 15*time.Second, "3rd delay should be capped by MaxBackoff")
+	assert.Ok(!p.exceeds(3), "3 restarts should be allowed")
+	assert.Ok(p.exceeds(4), "4 restarts should not be allowed")
+}
+
+func TestClassifyFailure(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	assert.EqInt(int(FRTunerBusy), int(ClassifyFailure(fmt.Errorf("Tuner is busy"))), "tuner busy")
+	// recpt1 cannot open the tuner used by another process.
+	assert.EqInt(int(FRTunerBusy), int(ClassifyFailure(fmt.Errorf("Cannot open tuner device"))), "tuner in use")
+	assert.EqInt(int(FRSignalLost), int(ClassifyFailure(fmt.Errorf("C/N = 0.000dB"))), "signal lost")
+	assert.EqInt(int(FRDiskFull), int(ClassifyFailure(fmt.Errorf("write /rec/a.ts: no space left on device"))), "disk full")
+	assert.EqInt(int(FRSignalLost), int(ClassifyFailure(&ErrRecordFailed{Reason: FRSignalLost})), "classified error")
+	assert.EqInt(int(FRUnknown), int(ClassifyFailure(fmt.Errorf("unexpected"))), "unknown")
+	assert.EqInt(int(FRSignalLost), int(ClassifyFailure(fmt.Errorf("Signal strength is too weak"))), "weak signal")
+	// errors of os/exec when the process is stopped or canceled.
+	assert.EqInt(int(FRUnknown), int(ClassifyFailure(fmt.Errorf("signal: killed"))), "killed process")
+	assert.EqInt(int(FRUnknown), int(ClassifyFailure(fmt.Errorf("signal: terminated"))), "terminated process")
+	// missing files are fatal only for the devices.
+	assert.EqInt(int(FRDeviceMissing), int(ClassifyFailure(fmt.Errorf("/dev/pt1video0: No such file or directory"))), "missing device")
+	assert.EqInt(int(FRDeviceMissing), int(ClassifyFailure(&os.PathError{Op: "open", Path: "/dev/pt1video0", Err: syscall.ENOENT})), "missing device")
+	assert.EqInt(int(FRUnknown), int(ClassifyFailure(&os.PathError{Op: "open", Path: "/rec/anime/a.ts", Err: syscall.ENOENT})), "missing output directory")
+	assert.EqInt(int(FRUnknown), int(ClassifyFailure(fmt.Errorf("open /rec/anime/a.ts: no such file or directory"))), "missing output directory")
+}
+
+func TestRecorderDrain(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, clock := newTestRecorder()
+	wait := 5
+
+	now := clock.Now()
+	r1 := NewDummyRecord("r1") // started before draining
+	r1.startAt = now
+	r1.endAt = now.Add(time.Duration(30 * time.Minute))
+	r2 := NewDummyRecord("r2") // waiting while draining
+	r2.startAt = now.Add(time.Duration(10 * time.Minute))
+	r2.endAt = now.Add(time.Duration(40 * time.Minute))
+	receiver <- []Record{r1, r2}
+	err := util.WaitFor(func() bool {
+		return stateOf(recorder, r1.Key()) == RSRecording
+	}, wait)
+	assert.Nil(err, "check r1 in RSRecording state.")
+
+	recorder.Drain()
+	assert.Ok(recorder.IsDraining(), "recorder should be draining.")
+	r3 := NewDummyRecord("r3") // new record while draining
+	r3.startAt = now.Add(time.Duration(10 * time.Minute))
+	r3.endAt = now.Add(time.Duration(40 * time.Minute))
+	receiver <- []Record{r1, r2, r3}
+	receiver <- []Record{r1, r2, r3} // returns after the previous update is merged.
+	clock.Advance(time.Duration(15 * time.Minute))
+	clock.BlockUntil(1) // r1 is checked and scheduled again.
+	assert.EqInt(2, numControls(recorder), "r3 should not be accepted while draining.")
+	assert.EqInt(int(RSWaiting), int(stateOf(recorder, r2.Key())), "r2 should not be started while draining.")
+	assert.EqInt(int(RSRecording), int(stateOf(recorder, r1.Key())), "r1 should continue while draining.")
+
+	recorder.Resume()
+	err = util.WaitFor(func() bool {
+		return stateOf(recorder, r2.Key()) == RSRecording
+	}, wait)
+	assert.Nil(err, "r2 should be started after resuming.")
+	recorder.Stop()
+}
+
+func TestRecorderShutdown(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, clock := newTestRecorder()
+	wait := 5
+
+	results := make(chan *RecordResult, 2)
+	recorder.OnResult(func(r *RecordResult) {
+		results <- r
+	})
+	now := clock.Now()
+	r1 := NewDummyRecord("r1")
+	r1.startAt = now
+	r1.endAt = now.Add(time.Duration(30 * time.Minute))
+	r2 := NewDummyRecord("r2")
+	r2.startAt = now.Add(time.Duration(10 * time.Minute))
+	r2.endAt = now.Add(time.Duration(40 * time.Minute))
+	receiver <- []Record{r1, r2}
+	err := util.WaitFor(func() bool {
+		return stateOf(recorder, r1.Key()) == RSRecording
+	}, wait)
+	assert.Nil(err, "check r1 in RSRecording state.")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- recorder.Shutdown(ctx)
+	}()
+	result := <-results
+	assert.EqStr(r2.Key(), result.Record.Key(), "r2 should be canceled first.")
+	assert.Ok(result.Err == ErrShutdown, "r2 should be canceled by shutdown.")
+
+	cancel()
+	err = <-done
+	assert.Ok(err == context.Canceled, "Shutdown should return the error of the context.")
+	result = <-results
+	assert.EqStr(r1.Key(), result.Record.Key(), "r1 should be stopped.")
+	err = util.WaitFor(func() bool {
+		return r1.IsDone()
+	}, wait)
+	assert.Nil(err, "r1 should be stopped.")
+}
+
+func TestRecorderShutdown_WaitRecording(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, clock := newTestRecorder()
+	wait := 5
+
+	now := clock.Now()
+	r1 := NewDummyRecord("r1")
+	r1.startAt = now
+	r1.endAt = now.Add(time.Duration(30 * time.Minute))
+	receiver <- []Record{r1}
+	err := util.WaitFor(func() bool {
+		return stateOf(recorder, r1.Key()) == RSRecording
+	}, wait)
+	assert.Nil(err, "check r1 in RSRecording state.")
+
+	ctx := &notifyContext{Context: context.Background(), waiting: make(chan bool, 1)}
+	done := make(chan error)
+	go func() {
+		done <- recorder.Shutdown(ctx)
+	}()
+	<-ctx.waiting
+	select {
+	case <-done:
+		t.Error("Shutdown should not return while r1 is recording.")
+	default:
+	}
+	clock.Advance(time.Duration(30 * time.Minute))
+	assert.Nil(<-done, "Shutdown should wait for r1 to finish.")
+	assert.EqInt(1, numSucceeded(recorder), "r1 should be succeeded.")
+}
+
+func TestRecorderShutdown_Restart(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder, receiver, _ := newTestRecorder()
+
+	assert.Nil(recorder.Shutdown(context.Background()), "Shutdown should stop the idle recorder.")
+	assert.Nil(recorder.Shutdown(context.Background()), "Shutdown should return immediately when not running.")
+
+	recorder.Resume()
+	go recorder.Run()
+	receiver <- []Record{}
+	recorder.Stop()
+	assert.Nil(recorder.Shutdown(context.Background()), "Shutdown after Stop should not block.")
+}
+
+func TestRecorderMerge_Reschedule(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	recorder := NewRecorder(make(chan []Record))
+	now := time.Now()
+	r1 := NewDummyRecord("r1")
+	r1.startAt = now.Add(time.Duration(1 * time.Hour))
+	r1.endAt = now.Add(time.Duration(2 * time.Hour))
+	recorder.merge([]Record{r1})
+
+	moved := NewDummyRecord("r1")
+	moved.startAt = now.Add(time.Duration(90 * time.Minute))
+	moved.endAt = now.Add(time.Duration(150 * time.Minute))
+	recorder.merge([]Record{moved})
+	ctrl := recorder.controls["r1"]
+	assert.Ok(ctrl.record == Record(moved), "Waiting record should be replaced.")
+	assert.Ok(ctrl.startAt.Equal(moved.startAt), "startAt should be moved.")
+	assert.Ok(ctrl.endAt.Equal(moved.endAt), "endAt should be moved.")
+
+	updated := NewDummyRecord("r1")
+	updated.startAt = moved.startAt
+	updated.endAt = moved.endAt
+	recorder.merge([]Record{updated})
+	assert.Ok(ctrl.record == Record(updated), "Waiting record should be replaced by the updated one.")
+}
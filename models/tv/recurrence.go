@@ -0,0 +1,228 @@
+package tv
+
+import (
+	"github.com/speedland/lib/util/jptext"
+	"github.com/speedland/wcg"
+	v "github.com/speedland/wcg/validation"
+	"strings"
+	"time"
+)
+
+type RecurrenceFrequency int
+
+var (
+	RFDaily    = RecurrenceFrequency(1)
+	RFWeekdays = RecurrenceFrequency(2) // Monday to Friday
+	RFWeekly   = RecurrenceFrequency(3) // on RecurringRule.Weekdays
+)
+
+// A program is regarded as the occurrence of a rule in the EPG if it
+// starts within this duration from the scheduled time.
+var RecurrenceAdjustWindow = 3 * time.Hour
+
+// RecurringRule is a series recording rule which expands into TvRecords.
+// The times are in JST, and StartTime may exceed 24:00 as TV schedules do
+// (e.g. 25:30 on Monday is 01:30 on Tuesday).
+type RecurringRule struct {
+	Id         string              `json:"id"`
+	Title      string              `json:"title"`
+	Category   string              `json:"category"`
+	Cid        string              `json:"cid"`
+	Sid        string              `json:"sid"`
+	Uid        string              `json:"uid"`
+	Frequency  RecurrenceFrequency `json:"frequency"`
+	Weekdays   []time.Weekday      `json:"weekdays"`
+	StartTime  int                 `json:"start_time"` // minutes from 00:00 of the broadcast date
+	Duration   int                 `json:"duration"`   // minutes
+	StartDate  time.Time           `json:"start_date"`
+	EndDate    time.Time           `json:"end_date"`   // zero for no end
+	Exceptions []time.Time         `json:"exceptions"` // broadcast dates to skip
+	CreatedAt  time.Time           `json:"created_at"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+}
+
+var RecurringRuleValidator = v.NewObjectValidator()
+
+func init() {
+	RecurringRuleValidator.Field("Id").Required().Match(ValidUUID)
+	RecurringRuleValidator.Field("Title").Required().
+		Unmatch(InvalidChars).Min(1).Max(64)
+	RecurringRuleValidator.Field("Category").Required().
+		Unmatch(InvalidChars).Min(1).Max(64)
+	RecurringRuleValidator.Field("Cid").Required()
+	RecurringRuleValidator.Field("Sid").Required()
+	RecurringRuleValidator.Field("StartDate").Required()
+	RecurringRuleValidator.Func(func(r interface{}) *v.FieldValidationError {
+		rule := r.(*RecurringRule)
+		if rule.Frequency != RFDaily && rule.Frequency != RFWeekdays && rule.Frequency != RFWeekly {
+			return v.NewFieldValidationError("繰り返し設定が不正です。", nil)
+		}
+		if rule.Frequency == RFWeekly && len(rule.Weekdays) == 0 {
+			return v.NewFieldValidationError("曜日が指定されていません。", nil)
+		}
+		if rule.StartTime < 0 || rule.StartTime >= 48*60 {
+			return v.NewFieldValidationError("開始時刻が不正です。", nil)
+		}
+		rt := time.Duration(rule.Duration) * time.Minute
+		if rt < MinRecordTime {
+			return v.NewFieldValidationError("録画時間が短すぎます。", nil)
+		}
+		if rt > MaxRecordTime {
+			return v.NewFieldValidationError("録画時間が長すぎます。", nil)
+		}
+		return nil
+	})
+}
+
+func NewRecurringRule(title string, category string, frequency RecurrenceFrequency,
+	startTime int, duration int, cid string, sid string, uid string) *RecurringRule {
+	now := time.Now()
+	return &RecurringRule{
+		Id:        wcg.Must(wcg.UUID()).(string),
+		Title:     title,
+		Category:  category,
+		Cid:       cid,
+		Sid:       sid,
+		Uid:       uid,
+		Frequency: frequency,
+		Weekdays:  make([]time.Weekday, 0),
+		StartTime: startTime,
+		Duration:  duration,
+		StartDate: broadcastDate(now),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func (rule *RecurringRule) Key() string {
+	return rule.Id
+}
+
+func (rule *RecurringRule) String() string {
+	return "RecurringRule:" + rule.Key()
+}
+
+// Occurrences returns the scheduled start times which start in [from, to).
+func (rule *RecurringRule) Occurrences(from time.Time, to time.Time) []time.Time {
+	list := make([]time.Time, 0)
+	offset := time.Duration(rule.StartTime) * time.Minute
+	// the occurrence on the day before `from` may start after `from`.
+	date := broadcastDate(from.Add(-offset))
+	if start := broadcastDate(rule.StartDate); date.Before(start) {
+		date = start
+	}
+	for ; date.Before(to); date = date.AddDate(0, 0, 1) {
+		if !rule.EndDate.IsZero() && date.After(broadcastDate(rule.EndDate)) {
+			break
+		}
+		if !rule.isScheduledOn(date) {
+			continue
+		}
+		t := date.Add(offset)
+		if !t.Before(from) && t.Before(to) {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func (rule *RecurringRule) isScheduledOn(date time.Time) bool {
+	for _, e := range rule.Exceptions {
+		if broadcastDate(e).Equal(date) {
+			return false
+		}
+	}
+	wd := date.Weekday()
+	switch rule.Frequency {
+	case RFDaily:
+		return true
+	case RFWeekdays:
+		return wd != time.Saturday && wd != time.Sunday
+	case RFWeekly:
+		for _, d := range rule.Weekdays {
+			if d == wd {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expand returns TvRecords for the occurrences in [from, to). If a program
+// in epgs on the same channel has the title of the rule around the scheduled
+// time, the record follows the time of the program.
+func (rule *RecurringRule) Expand(from time.Time, to time.Time, epgs []*Epg) []*TvRecord {
+	list := make([]*TvRecord, 0)
+	duration := time.Duration(rule.Duration) * time.Minute
+	for _, t := range rule.Occurrences(from, to) {
+		r := NewTvRecord(rule.Title, rule.Category, t, t.Add(duration),
+			rule.Cid, rule.Sid, rule.Uid)
+		r.RuleId = rule.Id
+		if epg := rule.findEpg(t, epgs); epg != nil {
+			r.StartAt = epg.StartAt
+			r.EndAt = epg.EndAt
+			r.EventId = epg.EventId
+			r.Meta = epg.Meta
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+// findEpg returns the nearest program to the scheduled time t.
+func (rule *RecurringRule) findEpg(t time.Time, epgs []*Epg) *Epg {
+	var found *Epg
+	var diff time.Duration
+	title := jptext.Fold(rule.Title)
+	for _, epg := range epgs {
+		if epg.Cid != rule.Cid || epg.Sid != rule.Sid || !strings.Contains(jptext.Fold(epg.Title), title) {
+			continue
+		}
+		d := epg.StartAt.Sub(t)
+		if d < 0 {
+			d = -d
+		}
+		if d <= RecurrenceAdjustWindow && (found == nil || d < diff) {
+			found, diff = epg, d
+		}
+	}
+	return found
+}
+
+// DedupeRecords returns the records in `generated` which are not duplicated
+// with `existing` or each other. Records are duplicated if they are on the
+// same channel and overlap, or refer the same EPG event.
+func DedupeRecords(existing []*TvRecord, generated []*TvRecord) []*TvRecord {
+	list := make([]*TvRecord, 0)
+	all := append(make([]*TvRecord, 0, len(existing)+len(generated)), existing...)
+	for _, r := range generated {
+		duplicated := false
+		for _, e := range all {
+			if isDuplicated(e, r) {
+				duplicated = true
+				break
+			}
+		}
+		if !duplicated {
+			list = append(list, r)
+			all = append(all, r)
+		}
+	}
+	return list
+}
+
+func isDuplicated(a *TvRecord, b *TvRecord) bool {
+	if a.Cid != b.Cid || a.Sid != b.Sid {
+		return false
+	}
+	if a.EventId != 0 && a.EventId == b.EventId {
+		return true
+	}
+	return a.StartAt.Before(b.EndAt) && b.StartAt.Before(a.EndAt)
+}
+
+// Returns 00:00 JST of the date of t.
+func broadcastDate(t time.Time) time.Time {
+	t = t.In(jst)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, jst)
+}
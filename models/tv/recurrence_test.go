@@ -0,0 +1,75 @@
+package tv
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+	"time"
+)
+
+func TestRecurringRuleValidator(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	rule := NewRecurringRule("ドラマ", "ドラマ", RFWeekly, 21*60, 54, "20", "hd", "me")
+	assert.NotNil(RecurringRuleValidator.Eval(rule), "Weekly rule needs weekdays.")
+	rule.Weekdays = []time.Weekday{time.Monday}
+	assert.Nil(RecurringRuleValidator.Eval(rule), "Valid rule.")
+	rule.Duration = 0
+	assert.NotNil(RecurringRuleValidator.Eval(rule), "Duration should be validated.")
+}
+
+func TestRecurringRuleOccurrences(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	// 2014-12-01 is Monday.
+	from := time.Date(2014, 12, 1, 0, 0, 0, 0, jst)
+	to := from.AddDate(0, 0, 14)
+
+	rule := NewRecurringRule("深夜アニメ", "アニメ", RFWeekly, 25*60+30, 30, "20", "hd", "me")
+	rule.Weekdays = []time.Weekday{time.Monday}
+	rule.StartDate = from
+	rule.Exceptions = []time.Time{time.Date(2014, 12, 8, 0, 0, 0, 0, jst)}
+	list := rule.Occurrences(from, to)
+	assert.EqInt(1, len(list), "Exception should be skipped.")
+	assert.Ok(list[0].Equal(time.Date(2014, 12, 2, 1, 30, 0, 0, jst)), "25:30 on Monday should be 01:30 on Tuesday.")
+
+	rule = NewRecurringRule("ニュース", "ニュース", RFWeekdays, 18*60, 60, "20", "hd", "me")
+	rule.StartDate = from
+	rule.EndDate = time.Date(2014, 12, 10, 0, 0, 0, 0, jst)
+	list = rule.Occurrences(from, to)
+	assert.EqInt(8, len(list), "Weekdays until EndDate.")
+
+	rule = NewRecurringRule("ニュース", "ニュース", RFDaily, 18*60, 60, "20", "hd", "me")
+	rule.StartDate = from
+	list = rule.Occurrences(from.Add(19*time.Hour), to)
+	assert.EqInt(13, len(list), "Occurrences should start after from.")
+}
+
+func TestRecurringRuleExpand(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	from := time.Date(2014, 12, 1, 0, 0, 0, 0, jst)
+	to := from.AddDate(0, 0, 7)
+	rule := NewRecurringRule("ドラマ", "ドラマ", RFWeekly, 21*60, 54, "20", "hd", "me")
+	rule.Weekdays = []time.Weekday{time.Monday, time.Wednesday}
+	rule.StartDate = from
+
+	// Wednesday's drama is delayed by a sports program.
+	delayed := &Epg{
+		EventId: 100,
+		Title:   "ドラマ　第３話【字】",
+		Cid:     "20",
+		Sid:     "hd",
+		StartAt: time.Date(2014, 12, 3, 21, 30, 0, 0, jst),
+		EndAt:   time.Date(2014, 12, 3, 22, 24, 0, 0, jst),
+	}
+	records := rule.Expand(from, to, []*Epg{delayed})
+	assert.EqInt(2, len(records), "Expand")
+	assert.EqStr(rule.Id, records[0].RuleId, "RuleId")
+	assert.Ok(records[0].StartAt.Equal(time.Date(2014, 12, 1, 21, 0, 0, 0, jst)), "Monday should be scheduled.")
+	assert.Ok(records[1].StartAt.Equal(delayed.StartAt), "Wednesday should follow EPG.")
+	assert.EqInt(100, records[1].EventId, "EventId should be taken from EPG.")
+
+	existing := []*TvRecord{
+		NewTvRecord("manual", "ドラマ", records[0].StartAt, records[0].EndAt, "20", "hd", "me"),
+	}
+	added := DedupeRecords(existing, append(records, rule.Expand(from, to, nil)...))
+	assert.EqInt(1, len(added), "Duplicated records should be removed.")
+	assert.Ok(added[0] == records[1], "Only the Wednesday record should be added.")
+}
@@ -0,0 +1,116 @@
+package tv
+
+import (
+	"container/heap"
+	"time"
+)
+
+// scheduler keeps the next deadline of each RecordCtrl in a min-heap
+// and arms a single timer for the earliest one.
+type scheduler struct {
+	clock Clock
+	queue scheduleQueue
+	items map[*RecordCtrl]*schedule
+	timer Timer
+}
+
+type schedule struct {
+	at    time.Time
+	ctrl  *RecordCtrl
+	index int
+}
+
+func newScheduler(clock Clock) *scheduler {
+	return &scheduler{
+		clock: clock,
+		queue: make(scheduleQueue, 0),
+		items: make(map[*RecordCtrl]*schedule),
+	}
+}
+
+// Set (or move) the deadline of the ctrl.
+func (s *scheduler) Schedule(ctrl *RecordCtrl, at time.Time) {
+	if item, ok := s.items[ctrl]; ok {
+		item.at = at
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item = &schedule{at: at, ctrl: ctrl}
+		heap.Push(&s.queue, item)
+		s.items[ctrl] = item
+	}
+	s.reset()
+}
+
+func (s *scheduler) Remove(ctrl *RecordCtrl) {
+	if item, ok := s.items[ctrl]; ok {
+		heap.Remove(&s.queue, item.index)
+		delete(s.items, ctrl)
+		s.reset()
+	}
+}
+
+// C returns the channel of the timer for the earliest deadline.
+// It returns nil if nothing is scheduled so that the receiver blocks.
+func (s *scheduler) C() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+	return s.timer.C()
+}
+
+// Due pops all ctrls whose deadlines are not after now.
+func (s *scheduler) Due(now time.Time) []*RecordCtrl {
+	list := make([]*RecordCtrl, 0)
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+		item := heap.Pop(&s.queue).(*schedule)
+		delete(s.items, item.ctrl)
+		list = append(list, item.ctrl)
+	}
+	s.reset()
+	return list
+}
+
+func (s *scheduler) Len() int {
+	return len(s.queue)
+}
+
+func (s *scheduler) reset() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.queue) > 0 {
+		s.timer = s.clock.NewTimer(s.queue[0].at.Sub(s.clock.Now()))
+	}
+}
+
+type scheduleQueue []*schedule
+
+func (q scheduleQueue) Len() int {
+	return len(q)
+}
+
+func (q scheduleQueue) Less(i, j int) bool {
+	return q[i].at.Before(q[j].at)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	item := x.(*schedule)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
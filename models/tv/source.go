@@ -0,0 +1,145 @@
+package tv
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// HttpGetter sends GET requests, which is satisfied by *http.Client.
+type HttpGetter interface {
+	Get(url string) (*http.Response, error)
+}
+
+type HttpGetterFunc func(url string) (*http.Response, error)
+
+func (f HttpGetterFunc) Get(url string) (*http.Response, error) {
+	return f(url)
+}
+
+// EpgSource is a provider of iEPG, which searches the programs and fetches
+// the iEPG of each program by the id.
+type EpgSource interface {
+	Name() string
+	Search(g HttpGetter, keyword string, scope int) ([]string, error)
+	Fetch(g HttpGetter, id string) (*IEpg, error)
+}
+
+// FeedEpgSource is an EpgSource which can return the feed items of the
+// search results, so that the programs can be filtered before fetching.
+type FeedEpgSource interface {
+	EpgSource
+	SearchItems(g HttpGetter, keyword string, scope int) ([]*FeedItem, error)
+}
+
+var DefaultEpgSource = "so-net"
+
+var epgSources = make(map[string]EpgSource)
+var epgSourcesMutex sync.RWMutex
+
+// RegisterEpgSource registers the source by its name, which replaces the
+// source registered with the same name.
+func RegisterEpgSource(source EpgSource) {
+	epgSourcesMutex.Lock()
+	defer epgSourcesMutex.Unlock()
+	epgSources[source.Name()] = source
+}
+
+func GetEpgSource(name string) (EpgSource, bool) {
+	epgSourcesMutex.RLock()
+	defer epgSourcesMutex.RUnlock()
+	source, ok := epgSources[name]
+	return source, ok
+}
+
+func init() {
+	RegisterEpgSource(NewSoNetSource(""))
+}
+
+// SoNetBaseURL is used by the SoNetSource without BaseURL, which is read on
+// each request so that it can be changed after the source is registered.
+var SoNetBaseURL = "http://tv.so-net.ne.jp"
+
+// SoNetSource is the EpgSource of Gガイド.テレビ王国 (tv.so-net.ne.jp).
+// BaseURL can be set to use a stand-in server, or empty for SoNetBaseURL.
+type SoNetSource struct {
+	BaseURL string
+}
+
+func NewSoNetSource(baseURL string) *SoNetSource {
+	return &SoNetSource{
+		BaseURL: baseURL,
+	}
+}
+
+const sonet_feed_path = "/rss/schedulesBySearch.action?stationPlatformId=%d&condition.keyword=%s"
+const sonet_iepg_path = "/iepg.tvpid?id=%s"
+
+func (s *SoNetSource) Name() string {
+	return "so-net"
+}
+
+func (s *SoNetSource) Search(g HttpGetter, keyword string, scope int) ([]string, error) {
+	items, err := s.SearchItems(g, keyword, scope)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Id != "" {
+			list = append(list, item.Id)
+		}
+	}
+	return list, nil
+}
+
+func (s *SoNetSource) SearchItems(g HttpGetter, keyword string, scope int) ([]*FeedItem, error) {
+	urlstr := s.url(sonet_feed_path, scope, url.QueryEscape(keyword))
+	resp, err := httpGet(g, urlstr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	items, err := ParseFeed(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse RSS from %q: %v", urlstr, err)
+	}
+	return items, nil
+}
+
+func (s *SoNetSource) Fetch(g HttpGetter, id string) (*IEpg, error) {
+	urlstr := s.url(sonet_iepg_path, url.QueryEscape(id))
+	resp, err := httpGet(g, urlstr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	iepg, err := ParseIEpg(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse iEPG from %q: %v", urlstr, err)
+	}
+	return iepg, nil
+}
+
+func (s *SoNetSource) url(path string, args ...interface{}) string {
+	base := s.BaseURL
+	if base == "" {
+		base = SoNetBaseURL
+	}
+	return strings.TrimSuffix(base, "/") + fmt.Sprintf(path, args...)
+}
+
+// httpGet returns the response if the status is 200.
+func httpGet(g HttpGetter, urlstr string) (*http.Response, error) {
+	resp, err := g.Get(urlstr)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP Error: %v (url = %q)", err, urlstr)
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Non-200 code (%d) was returned from %q", resp.StatusCode, urlstr)
+	}
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/wcg"
+	"net/http"
+	"testing"
+)
+
+type DummyEpgSource struct {
+	programs map[string]*IEpg
+}
+
+func (s *DummyEpgSource) Name() string {
+	return "dummy"
+}
+
+func (s *DummyEpgSource) Search(g HttpGetter, keyword string, scope int) ([]string, error) {
+	ids := make([]string, 0)
+	for id := range s.programs {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *DummyEpgSource) Fetch(g HttpGetter, id string) (*IEpg, error) {
+	if iepg, ok := s.programs[id]; ok {
+		return iepg, nil
+	}
+	return nil, fmt.Errorf("Not found")
+}
+
+func TestEpgSourceRegistry(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	source, ok := GetEpgSource(DefaultEpgSource)
+	assert.Ok(ok, "so-net source should be registered by default.")
+	assert.EqStr("so-net", source.Name(), "Name")
+	assert.EqStr(SoNetBaseURL+"/iepg.tvpid?id=1", source.(*SoNetSource).url(sonet_iepg_path, "1"), "url")
+	assert.Ok(NewCrawler(http.DefaultClient).Source == source, "Crawler should use the default source.")
+
+	RegisterEpgSource(&DummyEpgSource{map[string]*IEpg{
+		"1": &IEpg{ProgramTitle: "番組", StationId: "DFS00400"},
+	}})
+	crawler := NewCrawler(http.DefaultClient)
+	crawler.Interval = 0
+	list, errs := crawler.CrawlConfig(&CrawlerConfig{Source: "dummy", Keyword: "番組", Category: "test"})
+	assert.Nil(errs, "CrawlConfig should not return errors.")
+	assert.EqInt(1, len(list), "CrawlConfig should use the source of the config.")
+	assert.EqStr("1", list[0].Id, "Id")
+
+	_, errs = crawler.CrawlConfig(&CrawlerConfig{Source: "unknown", Keyword: "番組"})
+	assert.NotNil(errs, "CrawlConfig should fail for an unknown source.")
+}
+
+func TestSoNetSource_BaseURL(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	source, _ := GetEpgSource("so-net")
+	defer func(base string) { SoNetBaseURL = base }(SoNetBaseURL)
+	SoNetBaseURL = "http://localhost:8080/"
+	assert.EqStr("http://localhost:8080/iepg.tvpid?id=1", source.(*SoNetSource).url(sonet_iepg_path, "1"), "SoNetBaseURL should be read on each request.")
+	assert.EqStr("http://example.com/iepg.tvpid?id=1", NewSoNetSource("http://example.com").url(sonet_iepg_path, "1"), "BaseURL should be preferred.")
+}
+
+func TestNewCrawler_UnknownDefault(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	defer func(name string) { DefaultEpgSource = name }(DefaultEpgSource)
+	DefaultEpgSource = "unknown"
+	crawler := NewCrawler(http.DefaultClient)
+	assert.NotNil(crawler.Source, "Crawler should fall back to the so-net source.")
+	assert.EqStr("so-net", crawler.Source.Name(), "Name")
+
+	crawler.Source = nil
+	_, errs := crawler.CrawlConfig(&CrawlerConfig{Keyword: "番組"})
+	assert.NotNil(errs, "CrawlConfig should fail without the source.")
+}
@@ -0,0 +1,203 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bitrate in bytes per second used to estimate the size of a recording
+// when no bitrate is configured for the channel.
+var DefaultBitrate = int64(24 * 1000 * 1000 / 8)
+
+// StorageManager guards the recorder from starting recordings on a nearly
+// full disk and prunes old recordings by the retention policy.
+type StorageManager struct {
+	Dir string
+	// Bytes which should be left after the recording.
+	MinFreeBytes int64
+	// Start recordings even if the estimated size does not fit as long as
+	// MinFreeBytes is available, instead of refusing them.
+	Degrade bool
+	// Bitrates in bytes per second keyed by Cid or its prefix (e.g. "BS").
+	Bitrates  map[string]int64
+	Retention *RetentionPolicy
+	// Returns the available bytes in the directory.
+	FreeSpace func(dir string) (int64, error)
+	logger    wcg.Logger
+}
+
+// RetentionPolicy defines which recordings should be kept.
+// Zero values mean unlimited.
+type RetentionPolicy struct {
+	KeepPerCategory int           // keep the last N recordings in each category.
+	MaxAge          time.Duration // remove recordings ended before this duration.
+	MaxTotalBytes   int64         // remove older recordings when the total exceeds this.
+}
+
+// ChannelRecord is implemented by a Record which knows its channel so that
+// the size can be estimated by the bitrate of the channel.
+type ChannelRecord interface {
+	Channel() string
+}
+
+func NewStorageManager(dir string) *StorageManager {
+	return &StorageManager{
+		Dir:          dir,
+		MinFreeBytes: 1024 * 1024 * 1024,
+		Bitrates:     make(map[string]int64),
+		FreeSpace:    freeSpace,
+		logger:       util.GetLogger(),
+	}
+}
+
+// log returns the logger, which is unset if s is built without NewStorageManager.
+func (s *StorageManager) log() wcg.Logger {
+	if s.logger == nil {
+		return util.GetLogger()
+	}
+	return s.logger
+}
+
+// Bitrate returns the bitrate for the channel.
+func (s *StorageManager) Bitrate(cid string) int64 {
+	if b, ok := s.Bitrates[cid]; ok {
+		return b
+	}
+	prefix := ""
+	for k := range s.Bitrates {
+		if strings.HasPrefix(cid, k) && len(k) > len(prefix) {
+			prefix = k
+		}
+	}
+	if prefix != "" {
+		return s.Bitrates[prefix]
+	}
+	return DefaultBitrate
+}
+
+// EstimateBytes returns the bytes required to record the record.
+func (s *StorageManager) EstimateBytes(rec Record) int64 {
+	cid := ""
+	if c, ok := rec.(ChannelRecord); ok {
+		cid = c.Channel()
+	}
+	startAt, endAt := paddedWindow(rec)
+	return int64(endAt.Sub(startAt)/time.Second) * s.Bitrate(cid)
+}
+
+// Check returns an ErrRecordFailed with FRDiskFull if the record should not be
+// started, or an ErrDegraded with FRDiskFull if it is started in Degrade mode.
+func (s *StorageManager) Check(rec Record) error {
+	fs := s.FreeSpace
+	if fs == nil {
+		fs = freeSpace
+	}
+	free, err := fs(s.Dir)
+	if err != nil {
+		// not a disk full, the recording may still succeed.
+		s.log().Warn("Could not get the free space of %q: %v", s.Dir, err)
+		return nil
+	}
+	required := s.EstimateBytes(rec)
+	if free-required >= s.MinFreeBytes {
+		return nil
+	}
+	if s.Degrade && free >= s.MinFreeBytes {
+		return &ErrDegraded{
+			Reason: FRDiskFull,
+			Err:    fmt.Errorf("Only %d bytes are available for %d bytes, recording may be truncated", free, required),
+		}
+	}
+	return &ErrRecordFailed{
+		Reason: FRDiskFull,
+		Err:    fmt.Errorf("%d bytes are required but only %d bytes are available in %q", required+s.MinFreeBytes, free, s.Dir),
+	}
+}
+
+// Prune removes the files of the records which are not retained by the
+// retention policy and returns those records. The removed files are cleared
+// from rec.Files and rec.Size is updated, so the records only keep the files
+// which could not be removed.
+func (s *StorageManager) Prune(records []*TvRecord, now time.Time) ([]*TvRecord, []error) {
+	if s.Retention == nil {
+		return nil, nil
+	}
+	removals := s.Retention.Select(records, now)
+	errors := make([]error, 0)
+	for _, rec := range removals {
+		remaining := make([]string, 0)
+		for _, p := range rec.Files {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				errors = append(errors, err)
+				remaining = append(remaining, p)
+			}
+		}
+		s.log().Info("%v: Removed %d file(s) by retention policy.", rec, len(rec.Files)-len(remaining))
+		rec.Files = remaining
+		rec.Size = 0
+		for _, p := range remaining {
+			if info, err := os.Stat(p); err == nil {
+				rec.Size += info.Size()
+			}
+		}
+	}
+	if len(errors) > 0 {
+		return removals, errors
+	}
+	return removals, nil
+}
+
+// Select returns the records which should be removed. Only finished
+// recordings with output files are subject to the policy.
+func (p *RetentionPolicy) Select(records []*TvRecord, now time.Time) []*TvRecord {
+	list := make([]*TvRecord, 0)
+	for _, rec := range records {
+		if len(rec.Files) > 0 && !rec.EndAt.After(now) {
+			list = append(list, rec)
+		}
+	}
+	// newer first
+	sort.Sort(sort.Reverse(recordsByEndAt(list)))
+	removals := make([]*TvRecord, 0)
+	counts := make(map[string]int)
+	var total int64
+	exceeded := false
+	for _, rec := range list {
+		if p.MaxAge > 0 && now.Sub(rec.EndAt) > p.MaxAge {
+			removals = append(removals, rec)
+			continue
+		}
+		if p.KeepPerCategory > 0 && counts[rec.Category] >= p.KeepPerCategory {
+			removals = append(removals, rec)
+			continue
+		}
+		// older recordings are not kept once the newer one exceeds the limit.
+		if exceeded || (p.MaxTotalBytes > 0 && total+rec.Size > p.MaxTotalBytes) {
+			exceeded = true
+			removals = append(removals, rec)
+			continue
+		}
+		counts[rec.Category] += 1
+		total += rec.Size
+	}
+	return removals
+}
+
+type recordsByEndAt []*TvRecord
+
+func (l recordsByEndAt) Len() int {
+	return len(l)
+}
+
+func (l recordsByEndAt) Less(i, j int) bool {
+	return l[i].EndAt.Before(l[j].EndAt)
+}
+
+func (l recordsByEndAt) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
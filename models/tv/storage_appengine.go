@@ -0,0 +1,12 @@
+//go:build appengine
+// +build appengine
+
+package tv
+
+import (
+	"fmt"
+)
+
+func freeSpace(dir string) (int64, error) {
+	return 0, fmt.Errorf("Free space is not available on App Engine")
+}
@@ -0,0 +1,155 @@
+package tv
+
+import (
+	"fmt"
+	"github.com/speedland/lib/util"
+	"github.com/speedland/wcg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type ChannelDummyRecord struct {
+	*DummyRecord
+	cid string
+}
+
+func (dr *ChannelDummyRecord) Channel() string {
+	return dr.cid
+}
+
+func TestStorageManagerCheck(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	s := NewStorageManager("/rec")
+	s.MinFreeBytes = 100
+	s.Bitrates["BS"] = 10
+	s.Bitrates["BS15_0"] = 20
+	var free int64
+	s.FreeSpace = func(dir string) (int64, error) {
+		return free, nil
+	}
+	r := &ChannelDummyRecord{NewDummyRecord("r"), "BS15_1"}
+	r.startAt = time.Now()
+	r.endAt = r.startAt.Add(100 * time.Second)
+	assert.Ok(s.EstimateBytes(r) == 1000, "EstimateBytes should use the bitrate of the prefix.")
+	r.cid = "BS15_0"
+	assert.Ok(s.EstimateBytes(r) == 2000, "EstimateBytes should use the bitrate of the channel.")
+
+	free = 2100
+	assert.Nil(s.Check(r), "Check should pass when the space is enough.")
+
+	free = 2099
+	err := s.Check(r)
+	assert.NotNil(err, "Check should return an error when the space is not enough.")
+	assert.EqInt(int(FRDiskFull), int(ClassifyFailure(err)), "Check should return FRDiskFull.")
+
+	s.Degrade = true
+	err = s.Check(r)
+	_, ok := err.(*ErrDegraded)
+	assert.Ok(ok, "Check should pass in Degrade mode as long as MinFreeBytes is available.")
+	assert.EqInt(int(FRDiskFull), int(ClassifyFailure(err)), "Degraded reason should be FRDiskFull.")
+
+	ctrl := NewRecordCtrl(r)
+	ctrl.storage = s
+	ctrl.control(r.startAt)
+	assert.EqInt(int(RSRecording), int(ctrl.state), "Degraded record should be started.")
+	assert.NotNil(ctrl.Result().Degraded, "Degraded reason should be recorded.")
+	r.Stop()
+	free = 99
+	assert.NotNil(s.Check(r), "Check should not pass in Degrade mode when MinFreeBytes is not available.")
+}
+
+func TestStorageManagerCheck_Literal(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	s := &StorageManager{
+		Dir: "/rec",
+		FreeSpace: func(dir string) (int64, error) {
+			return 0, fmt.Errorf("statfs %s: no such file or directory", dir)
+		},
+	}
+	r := NewDummyRecord("r")
+	r.startAt = time.Now()
+	r.endAt = r.startAt.Add(100 * time.Second)
+	assert.Nil(s.Check(r), "Check should pass without the logger when the free space is unknown.")
+}
+
+func TestRetentionPolicySelect(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	now := time.Now()
+	newRecord := func(category string, hoursAgo int, size int64) *TvRecord {
+		r := genTestRecord()
+		r.Category = category
+		r.EndAt = now.Add(time.Duration(-hoursAgo) * time.Hour)
+		r.StartAt = r.EndAt.Add(-30 * time.Minute)
+		r.Files = []string{r.Id + ".ts"}
+		r.Size = size
+		return r
+	}
+	a1 := newRecord("a", 1, 10)
+	a2 := newRecord("a", 2, 10)
+	a3 := newRecord("a", 3, 10)
+	b1 := newRecord("b", 4, 10)
+	b2 := newRecord("b", 100, 10)
+	records := []*TvRecord{a3, b2, a1, b1, a2}
+
+	p := &RetentionPolicy{KeepPerCategory: 2}
+	removals := p.Select(records, now)
+	assert.EqInt(1, len(removals), "KeepPerCategory")
+	assert.EqStr(a3.Id, removals[0].Id, "the oldest in a should be removed.")
+
+	p = &RetentionPolicy{MaxAge: 24 * time.Hour}
+	removals = p.Select(records, now)
+	assert.EqInt(1, len(removals), "MaxAge")
+	assert.EqStr(b2.Id, removals[0].Id, "b2 should be removed by MaxAge.")
+
+	p = &RetentionPolicy{MaxTotalBytes: 30}
+	removals = p.Select(records, now)
+	assert.EqInt(2, len(removals), "MaxTotalBytes")
+	assert.EqStr(b1.Id, removals[0].Id, "b1 should be removed by MaxTotalBytes.")
+	assert.EqStr(b2.Id, removals[1].Id, "b2 should be removed by MaxTotalBytes.")
+
+	newest := newRecord("c", 1, 80)
+	middle := newRecord("c", 2, 30)
+	oldest := newRecord("c", 3, 10)
+	p = &RetentionPolicy{MaxTotalBytes: 100}
+	removals = p.Select([]*TvRecord{oldest, newest, middle}, now)
+	assert.EqInt(2, len(removals), "Older records should be removed once MaxTotalBytes is exceeded.")
+	assert.EqStr(middle.Id, removals[0].Id, "middle should be removed.")
+	assert.EqStr(oldest.Id, removals[1].Id, "oldest should be removed even if it fits.")
+}
+
+func TestStorageManagerPrune(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	util.WithTempDir(func(dir string) {
+		now := time.Now()
+		s := NewStorageManager(dir)
+		s.Retention = &RetentionPolicy{MaxAge: 24 * time.Hour}
+		old := genTestRecord()
+		old.EndAt = now.Add(-48 * time.Hour)
+		old.StartAt = old.EndAt.Add(-30 * time.Minute)
+		old.Files = []string{filepath.Join(dir, "old.ts"), filepath.Join(dir, "old.1.ts")}
+		old.Size = 20
+		recent := genTestRecord()
+		recent.EndAt = now.Add(-1 * time.Hour)
+		recent.StartAt = recent.EndAt.Add(-30 * time.Minute)
+		recent.Files = []string{filepath.Join(dir, "recent.ts")}
+		recent.Size = 10
+		for _, p := range append(old.Files, recent.Files...) {
+			ioutil.WriteFile(p, []byte("0123456789"), 0644)
+		}
+
+		removals, errs := s.Prune([]*TvRecord{old, recent}, now)
+		assert.Nil(errs, "Prune should not return errors.")
+		assert.EqInt(1, len(removals), "Prune should return the removed record.")
+		assert.EqStr(old.Id, removals[0].Id, "old should be removed.")
+		assert.EqInt(0, len(old.Files), "Removed files should be cleared.")
+		assert.Ok(old.Size == 0, "Size should be cleared.")
+		_, err := os.Stat(filepath.Join(dir, "old.ts"))
+		assert.Ok(os.IsNotExist(err), "File should be removed.")
+		assert.EqInt(1, len(recent.Files), "Retained files should be kept.")
+		_, err = os.Stat(recent.Files[0])
+		assert.Nil(err, "Retained file should exist.")
+	})
+}
@@ -0,0 +1,292 @@
+package tv
+
+import (
+	"code.google.com/p/go.text/encoding/japanese"
+	"code.google.com/p/go.text/transform"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XMLTV (http://wiki.xmltv.org/index.php/XMLTVFormat) schema.
+// Programmes and channels are identified by "{Cid}_{Sid}" as epgdump does.
+type xmltvDoc struct {
+	XMLName       xml.Name          `xml:"tv"`
+	GeneratorName string            `xml:"generator-info-name,attr,omitempty"`
+	Channels      []*xmltvChannel   `xml:"channel"`
+	Programmes    []*xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+	Id           string       `xml:"id,attr"`
+	DisplayNames []*xmltvText `xml:"display-name"`
+}
+
+type xmltvProgramme struct {
+	Start       string             `xml:"start,attr"`
+	Stop        string             `xml:"stop,attr,omitempty"`
+	Channel     string             `xml:"channel,attr"`
+	Titles      []*xmltvText       `xml:"title"`
+	Descs       []*xmltvText       `xml:"desc"`
+	Categories  []*xmltvText       `xml:"category"`
+	EpisodeNums []*xmltvEpisodeNum `xml:"episode-num"`
+}
+
+type xmltvEpisodeNum struct {
+	System string `xml:"system,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+type xmltvText struct {
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+var XMLTVGeneratorName = "speedland"
+
+const (
+	xmltv_lang          = "ja_JP"
+	xmltv_time_layout   = "20060102150405 -0700"
+	xmltv_category_sep  = " / "
+	xmltv_extdetail_fmt = "【%s】%s"
+	// episode-num system to carry the event id, as XMLTV has no attribute for it.
+	xmltv_event_id_system = "arib-event-id"
+)
+
+var xmltvTimeLayouts = []string{
+	"20060102150405 -0700",
+	"20060102150405",
+	"200601021504 -0700",
+	"200601021504",
+}
+
+// ParseXMLTV parses the XMLTV document into the programs and the channels.
+// Category.Middle is parsed from the category in "{Large} / {Middle}" form
+// and ExtDetails from the descriptions in "【{key}】{value}" form after the
+// first one, which is the form WriteXMLTV uses. EventId is parsed from the
+// episode-num of the "arib-event-id" system.
+func ParseXMLTV(r io.Reader) ([]*Epg, []*TvChannel, error) {
+	var doc xmltvDoc
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = xmltvCharsetReader
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("Could not parse XMLTV: %v", err)
+	}
+	channels := make([]*TvChannel, 0)
+	for _, c := range doc.Channels {
+		ch := &TvChannel{}
+		ch.Cid, ch.Sid = parseXMLTVChannel(c.Id)
+		ch.Name = selectXMLTVText(c.DisplayNames)
+		channels = append(channels, ch)
+	}
+	epgs := make([]*Epg, 0)
+	for i, p := range doc.Programmes {
+		epg, err := newEpgFromXMLTV(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("programme[%d] (%s): %v", i, p.Channel, err)
+		}
+		epgs = append(epgs, epg)
+	}
+	return epgs, channels, nil
+}
+
+func newEpgFromXMLTV(p *xmltvProgramme) (*Epg, error) {
+	var err error
+	epg := &Epg{
+		Categories: make([]Category, 0),
+		ExtDetails: make(map[string]string),
+	}
+	epg.Cid, epg.Sid = parseXMLTVChannel(p.Channel)
+	if epg.StartAt, err = parseXMLTVTime(p.Start); err != nil {
+		return nil, err
+	}
+	if p.Stop != "" {
+		if epg.EndAt, err = parseXMLTVTime(p.Stop); err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range p.EpisodeNums {
+		if n.System != xmltv_event_id_system {
+			continue
+		}
+		value := strings.TrimSpace(n.Value)
+		if epg.EventId, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("Invalid event id %q", value)
+		}
+	}
+	epg.Title = selectXMLTVText(p.Titles)
+	for i, d := range filterXMLTVText(p.Descs) {
+		if i == 0 {
+			epg.Detail = []byte(d.Value)
+			continue
+		}
+		if key, value, ok := parseXMLTVExtDetail(d.Value); ok {
+			epg.ExtDetails[key] = value
+		}
+	}
+	for _, c := range filterXMLTVText(p.Categories) {
+		s := strings.SplitN(c.Value, xmltv_category_sep, 2)
+		category := Category{Large: s[0]}
+		if len(s) == 2 {
+			category.Middle = s[1]
+		}
+		if g, ok := LookupGenre(category.Large, category.Middle); ok {
+			category.Code = &g.Code
+		}
+		epg.Categories = append(epg.Categories, category)
+	}
+	epg.ExtractMeta()
+	return epg, nil
+}
+
+// WriteXMLTV writes the channels and the programs as an XMLTV document.
+func WriteXMLTV(w io.Writer, channels []*TvChannel, epgs []*Epg) error {
+	doc := &xmltvDoc{
+		GeneratorName: XMLTVGeneratorName,
+		Channels:      make([]*xmltvChannel, 0, len(channels)),
+		Programmes:    make([]*xmltvProgramme, 0, len(epgs)),
+	}
+	for _, c := range channels {
+		doc.Channels = append(doc.Channels, &xmltvChannel{
+			Id:           xmltvChannelId(c.Cid, c.Sid),
+			DisplayNames: []*xmltvText{{Lang: xmltv_lang, Value: c.Name}},
+		})
+	}
+	for _, epg := range epgs {
+		p := &xmltvProgramme{
+			Start:      epg.StartAt.In(jst).Format(xmltv_time_layout),
+			Channel:    xmltvChannelId(epg.Cid, epg.Sid),
+			Titles:     []*xmltvText{{Lang: xmltv_lang, Value: epg.Title}},
+			Descs:      make([]*xmltvText, 0),
+			Categories: make([]*xmltvText, 0),
+		}
+		if !epg.EndAt.IsZero() {
+			p.Stop = epg.EndAt.In(jst).Format(xmltv_time_layout)
+		}
+		if len(epg.Detail) > 0 || len(epg.ExtDetails) > 0 {
+			p.Descs = append(p.Descs, &xmltvText{Lang: xmltv_lang, Value: string(epg.Detail)})
+		}
+		keys := make([]string, 0, len(epg.ExtDetails))
+		for k := range epg.ExtDetails {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p.Descs = append(p.Descs, &xmltvText{
+				Lang:  xmltv_lang,
+				Value: fmt.Sprintf(xmltv_extdetail_fmt, k, epg.ExtDetails[k]),
+			})
+		}
+		for _, c := range epg.Categories {
+			value := c.Large
+			if c.Middle != "" {
+				value = value + xmltv_category_sep + c.Middle
+			}
+			p.Categories = append(p.Categories, &xmltvText{Lang: xmltv_lang, Value: value})
+		}
+		english := make([]string, 0)
+		for _, c := range epg.Categories {
+			if g := c.Genre(); g != nil {
+				for _, value := range g.XMLTVCategories() {
+					if !containsString(english, value) {
+						english = append(english, value)
+					}
+				}
+			}
+		}
+		for _, value := range english {
+			p.Categories = append(p.Categories, &xmltvText{Lang: "en", Value: value})
+		}
+		if epg.EventId != 0 {
+			p.EpisodeNums = []*xmltvEpisodeNum{{
+				System: xmltv_event_id_system,
+				Value:  strconv.Itoa(epg.EventId),
+			}}
+		}
+		doc.Programmes = append(doc.Programmes, p)
+	}
+	if _, err := io.WriteString(w, xml.Header+"<!DOCTYPE tv SYSTEM \"xmltv.dtd\">\n"); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func xmltvChannelId(cid string, sid string) string {
+	if sid == "" {
+		return cid
+	}
+	return cid + "_" + sid
+}
+
+// Channel ids of other tools which are not in "{Cid}_{Sid}" form are used as Cid.
+func parseXMLTVChannel(id string) (string, string) {
+	if cid, sid, err := parseChannel(id); err == nil {
+		return cid, sid
+	}
+	return id, ""
+}
+
+func parseXMLTVTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range xmltvTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q", s)
+}
+
+func parseXMLTVExtDetail(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, "【") {
+		return "", "", false
+	}
+	i := strings.Index(s, "】")
+	if i < 0 {
+		return "", "", false
+	}
+	return s[len("【"):i], s[i+len("】"):], true
+}
+
+// filterXMLTVText returns the Japanese texts, or all texts if there are no
+// Japanese texts.
+func filterXMLTVText(list []*xmltvText) []*xmltvText {
+	filtered := make([]*xmltvText, 0, len(list))
+	for _, t := range list {
+		if t.Lang == "" || strings.HasPrefix(t.Lang, "ja") {
+			filtered = append(filtered, t)
+		}
+	}
+	if len(filtered) == 0 {
+		return list
+	}
+	return filtered
+}
+
+func selectXMLTVText(list []*xmltvText) string {
+	if list = filterXMLTVText(list); len(list) > 0 {
+		return list[0].Value
+	}
+	return ""
+}
+
+func xmltvCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "shift_jis", "sjis", "windows-31j":
+		return transform.NewReader(input, japanese.ShiftJIS.NewDecoder()), nil
+	case "euc-jp":
+		return transform.NewReader(input, japanese.EUCJP.NewDecoder()), nil
+	case "iso-2022-jp":
+		return transform.NewReader(input, japanese.ISO2022JP.NewDecoder()), nil
+	}
+	return nil, fmt.Errorf("Unsupported charset %q", charset)
+}
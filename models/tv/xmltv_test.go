@@ -0,0 +1,100 @@
+package tv
+
+import (
+	"bytes"
+	"github.com/speedland/wcg"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseXMLTV(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	f, err := os.Open("testdata/xmltv_sample.xml")
+	assert.Nil(err, "Open the sample file")
+	defer f.Close()
+	epgs, channels, err := ParseXMLTV(f)
+	assert.Nil(err, "ParseXMLTV should not return an error.")
+	assert.EqInt(2, len(channels), "Number of channels")
+	assert.EqStr("GR5", channels[0].Cid, "Cid")
+	assert.EqStr("1064", channels[0].Sid, "Sid")
+	assert.EqStr("テレビ朝日", channels[0].Name, "Japanese name should be preferred.")
+
+	assert.EqInt(2, len(epgs), "Number of programs")
+	p := epgs[0]
+	assert.EqInt(22529, p.EventId, "EventId")
+	assert.EqStr("GR5", p.Cid, "Cid")
+	assert.EqStr("ＡＮＮニュース・あすの空もよう【字】", p.Title, "Title")
+	assert.EqStr("正確なニュース・情報をいち早くお伝えします。", string(p.Detail), "Detail")
+	assert.EqStr("富川悠太", p.ExtDetails["出演者"], "ExtDetails")
+	assert.EqInt(2, len(p.Categories), "English categories should be ignored.")
+	assert.EqStr("ニュース／報道", p.Categories[1].Large, "Category.Large")
+	assert.EqStr("天気", p.Categories[1].Middle, "Category.Middle")
+	assert.Ok(time.Date(2014, 6, 4, 6, 0, 0, 0, jst).Equal(p.StartAt), "StartAt")
+	assert.Ok(time.Date(2014, 6, 4, 6, 45, 0, 0, jst).Equal(p.EndAt), "EndAt")
+
+	p = epgs[1]
+	assert.EqStr("World News", p.Title, "Title should fall back to other languages.")
+	assert.EqStr("news", p.Categories[0].Large, "Category should fall back to other languages.")
+	assert.Ok(time.Date(2014, 6, 4, 7, 0, 0, 0, jst).Equal(p.StartAt), "StartAt in UTC")
+
+	_, _, err = ParseXMLTV(bytes.NewBufferString(`<tv><programme start="2014" channel="GR5_1064"/></tv>`))
+	assert.NotNil(err, "ParseXMLTV should return an error for invalid time.")
+	_, _, err = ParseXMLTV(bytes.NewBufferString(`<tv><programme start="20140604060000 +0900" channel="GR5_1064"><episode-num system="arib-event-id">x</episode-num></programme></tv>`))
+	assert.NotNil(err, "ParseXMLTV should return an error for invalid event id.")
+}
+
+func TestWriteXMLTV_RoundTrip(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	f, err := os.Open("testdata/xmltv_sample.xml")
+	assert.Nil(err, "Open the sample file")
+	defer f.Close()
+	epgs, channels, _ := ParseXMLTV(f)
+
+	var buff bytes.Buffer
+	assert.Nil(WriteXMLTV(&buff, channels, epgs), "WriteXMLTV should not return an error.")
+	epgs2, channels2, err := ParseXMLTV(&buff)
+	assert.Nil(err, "ParseXMLTV should parse the output of WriteXMLTV.")
+	assertSameChannels(assert, channels, channels2)
+	assertSameEpgs(assert, epgs, epgs2)
+	assert.Ok(!strings.Contains(buff.String(), "event_id"), "WriteXMLTV should not write nonstandard attributes.")
+
+	// from epgdump JSON
+	epgs, _ = ParseEpgJsonString(testJson)
+	buff.Reset()
+	assert.Nil(WriteXMLTV(&buff, nil, epgs), "WriteXMLTV should not return an error.")
+	epgs2, _, err = ParseXMLTV(&buff)
+	assert.Nil(err, "ParseXMLTV should parse the output of WriteXMLTV.")
+	assertSameEpgs(assert, epgs, epgs2)
+}
+
+func assertSameChannels(assert *wcg.Assert, a []*TvChannel, b []*TvChannel) {
+	assert.EqInt(len(a), len(b), "Number of channels")
+	for i := range a {
+		assert.EqStr(a[i].Key(), b[i].Key(), "Channel key")
+		assert.EqStr(a[i].Name, b[i].Name, "Channel name")
+	}
+}
+
+func assertSameEpgs(assert *wcg.Assert, a []*Epg, b []*Epg) {
+	assert.EqInt(len(a), len(b), "Number of programs")
+	for i := range a {
+		assert.EqInt(a[i].EventId, b[i].EventId, "EventId")
+		assert.EqStr(a[i].Cid, b[i].Cid, "Cid")
+		assert.EqStr(a[i].Sid, b[i].Sid, "Sid")
+		assert.EqStr(a[i].Title, b[i].Title, "Title")
+		assert.EqStr(string(a[i].Detail), string(b[i].Detail), "Detail")
+		assert.Ok(a[i].StartAt.Equal(b[i].StartAt), "StartAt")
+		assert.Ok(a[i].EndAt.Equal(b[i].EndAt), "EndAt")
+		assert.EqInt(len(a[i].Categories), len(b[i].Categories), "Number of categories")
+		for j := range a[i].Categories {
+			assert.EqStr(a[i].Categories[j].Large, b[i].Categories[j].Large, "Category.Large")
+			assert.EqStr(a[i].Categories[j].Middle, b[i].Categories[j].Middle, "Category.Middle")
+		}
+		assert.EqInt(len(a[i].ExtDetails), len(b[i].ExtDetails), "Number of ExtDetails")
+		for k, v := range a[i].ExtDetails {
+			assert.EqStr(v, b[i].ExtDetails[k], "ExtDetails")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package jptext normalizes Japanese texts in EPG such as program titles.
+package jptext
+
+import (
+	"code.google.com/p/go.text/unicode/norm"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Flags are the ARIB symbols in the program title.
+type Flags struct {
+	Rerun         bool `json:"rerun"`          // 【再】
+	Subtitled     bool `json:"subtitled"`      // 【字】
+	DataBroadcast bool `json:"data_broadcast"` // 【デ】
+	New           bool `json:"new"`            // 【新】
+	Final         bool `json:"final"`          // 【終】
+}
+
+// ARIB additional symbols in Unicode (Enclosed Ideographic Supplement),
+// which are folded into the bracket forms by Normalize.
+var aribSymbols = map[rune]string{
+	'\U0001F211': "字",
+	'\U0001F213': "デ",
+	'\U0001F21E': "再",
+	'\U0001F21F': "新",
+	'\U0001F221': "終",
+}
+
+var flagRegexp = regexp.MustCompile(`[【\[［]([再字デ新終])[】\]］]`)
+
+var spaceRegexp = regexp.MustCompile(`\s+`)
+
+var episodeRegexp = regexp.MustCompile(`第\s*([0-9]+|[〇一二三四五六七八九十百]+)\s*[話回]|#\s*([0-9]+)`)
+
+// FoldSymbols folds the ARIB symbols into the bracket forms like 【再】
+// without changing the other characters.
+func FoldSymbols(s string) string {
+	var buff []rune
+	for _, r := range s {
+		if symbol, ok := aribSymbols[r]; ok {
+			buff = append(buff, []rune("【"+symbol+"】")...)
+		} else {
+			buff = append(buff, r)
+		}
+	}
+	return string(buff)
+}
+
+// Normalize folds the width of the characters by NFKC, the ARIB symbols into
+// the bracket forms like 【再】, and the spaces into a single space.
+func Normalize(s string) string {
+	s = norm.NFKC.String(FoldSymbols(s))
+	s = flagRegexp.ReplaceAllString(s, "【$1】")
+	return strings.TrimSpace(spaceRegexp.ReplaceAllString(s, " "))
+}
+
+// ExtractFlags normalizes the string and returns it without the ARIB flag
+// symbols, and the flags.
+func ExtractFlags(s string) (string, Flags) {
+	var flags Flags
+	s = Normalize(s)
+	s = flagRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		switch flagRegexp.FindStringSubmatch(m)[1] {
+		case "再":
+			flags.Rerun = true
+		case "字":
+			flags.Subtitled = true
+		case "デ":
+			flags.DataBroadcast = true
+		case "新":
+			flags.New = true
+		case "終":
+			flags.Final = true
+		}
+		return " "
+	})
+	return strings.TrimSpace(spaceRegexp.ReplaceAllString(s, " ")), flags
+}
+
+// NormalizeEpisode rewrites the episode numbers like "第3話", "第三回" and
+// "#03" into "#3". The string should be normalized.
+func NormalizeEpisode(s string) string {
+	return episodeRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if n, ok := parseEpisode(episodeRegexp.FindStringSubmatch(m)); ok {
+			return "#" + strconv.Itoa(n)
+		}
+		return m
+	})
+}
+
+// RemoveEpisode returns the string without the episode numbers like "第3話"
+// and "#3". The string should be normalized.
+func RemoveEpisode(s string) string {
+	s = episodeRegexp.ReplaceAllString(s, " ")
+	return strings.TrimSpace(spaceRegexp.ReplaceAllString(s, " "))
+}
+
+// Episode returns the first episode number in the string.
+func Episode(s string) (int, bool) {
+	for _, m := range episodeRegexp.FindAllStringSubmatch(norm.NFKC.String(s), -1) {
+		if n, ok := parseEpisode(m); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// Fold returns the string to compare texts in matching and searching, which
+// is normalized and case folded, and has the normalized episode numbers.
+func Fold(s string) string {
+	return strings.ToLower(NormalizeEpisode(Normalize(s)))
+}
+
+func parseEpisode(m []string) (int, bool) {
+	if m[2] != "" {
+		n, err := strconv.Atoi(m[2])
+		return n, err == nil
+	}
+	if n, err := strconv.Atoi(m[1]); err == nil {
+		return n, true
+	}
+	return parseKanjiNumber(m[1])
+}
+
+var kanjiDigits = map[rune]int{
+	'〇': 0, '一': 1, '二': 2, '三': 3, '四': 4,
+	'五': 5, '六': 6, '七': 7, '八': 8, '九': 9,
+}
+
+// parseKanjiNumber parses the numbers less than 1000 like "百二十三".
+func parseKanjiNumber(s string) (int, bool) {
+	total, digit := 0, -1
+	for _, r := range s {
+		switch r {
+		case '十', '百':
+			unit := 10
+			if r == '百' {
+				unit = 100
+			}
+			if digit < 0 {
+				digit = 1
+			}
+			total += digit * unit
+			digit = -1
+		default:
+			d, ok := kanjiDigits[r]
+			if !ok {
+				return 0, false
+			}
+			if digit > 0 {
+				// positional form like "二五"
+				digit = digit*10 + d
+			} else {
+				digit = d
+			}
+		}
+	}
+	if digit > 0 {
+		total += digit
+	}
+	return total, total > 0
+}
@@ -0,0 +1,53 @@
+package jptext
+
+import (
+	"github.com/speedland/wcg"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	assert.EqStr("ANNニュース", Normalize("ＡＮＮニュース"), "Full-width alphabets")
+	assert.EqStr("アニメ 123", Normalize("ｱﾆﾒ　１２３"), "Half-width katakana and full-width space")
+	assert.EqStr("ドラマ【再】【字】", Normalize("ドラマ\U0001F21E[字]"), "ARIB symbols")
+	assert.EqStr("The Girls Live", Normalize(" The　 Girls　Live "), "Spaces")
+}
+
+func TestExtractFlags(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	s, flags := ExtractFlags("【新】ドラマ　第１話【字】【デ】")
+	assert.EqStr("ドラマ 第1話", s, "Flags should be stripped.")
+	assert.Ok(flags.New && flags.Subtitled && flags.DataBroadcast, "Flags")
+	assert.Ok(!flags.Rerun && !flags.Final, "Flags")
+
+	s, flags = ExtractFlags("ドラマ［終］\U0001F21E")
+	assert.EqStr("ドラマ", s, "Flags should be stripped.")
+	assert.Ok(flags.Final && flags.Rerun, "Flags in other forms")
+
+	s, _ = ExtractFlags("【特集】ニュース")
+	assert.EqStr("【特集】ニュース", s, "Other brackets should be kept.")
+}
+
+func TestEpisode(t *testing.T) {
+	assert := wcg.NewAssert(t)
+	for s, expected := range map[string]int{
+		"ドラマ 第３話":    3,
+		"ドラマ 第十二話":   12,
+		"ドラマ 第二十回":   20,
+		"ドラマ 第百五話":   105,
+		"ドラマ ＃０５":    5,
+		"ドラマ #12「題」": 12,
+	} {
+		n, ok := Episode(s)
+		assert.Ok(ok, "Episode should be found in "+s)
+		assert.EqInt(expected, n, "Episode of "+s)
+	}
+	_, ok := Episode("ドラマ")
+	assert.Ok(!ok, "Episode should not be found.")
+
+	assert.EqStr("ドラマ #3", NormalizeEpisode("ドラマ 第三話"), "NormalizeEpisode")
+	assert.EqStr("ドラマ 「題」", RemoveEpisode("ドラマ 第三話 「題」"), "RemoveEpisode")
+	assert.EqStr("ドラマ", RemoveEpisode("ドラマ #12"), "RemoveEpisode")
+	assert.EqStr(Fold("ドラマ　#3"), Fold("ドラマ 第3話"), "Fold")
+	assert.EqStr("drama #3", Fold("ＤＲＡＭＡ　第３話"), "Fold")
+}